@@ -0,0 +1,278 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit status used when an alert fires, distinct from the status 1 of errors
+// and 2 of invalid flags
+const alertExitCode = 3
+
+// An alert rule of the form <scope>[=<name>]>N%[:<count>], e.g.
+//
+//	thread>90%:3                      any single thread above 90% for 3 samples
+//	pool=epollEventLoopGroup-*>150%   a matching pool above 150% combined
+//	total>400%:2                      the whole process above 400% for 2 samples
+//
+// Names may use path.Match style wildcards.
+type alertRule struct {
+	text      string
+	scope     string
+	name      string
+	threshold float64
+	count     int
+}
+
+func parseAlertRule(s string) (*alertRule, error) {
+	rule := &alertRule{text: s, count: 1}
+
+	gt := strings.LastIndexByte(s, '>')
+	if gt < 0 {
+		return nil, fmt.Errorf("invalid alert \"%s\" (expected <scope>>N%%)", s)
+	}
+	scope, limit := s[:gt], s[gt+1:]
+
+	if i := strings.IndexByte(scope, '='); i >= 0 {
+		scope, rule.name = scope[:i], scope[i+1:]
+		if _, err := path.Match(rule.name, ""); err != nil {
+			return nil, fmt.Errorf("invalid alert \"%s\": %w", s, err)
+		}
+	}
+	switch scope {
+	case "thread", "pool", "total":
+		rule.scope = scope
+	default:
+		return nil, fmt.Errorf("invalid alert \"%s\" (scope must be thread, pool or total)", s)
+	}
+	if scope == "total" && rule.name != "" {
+		return nil, fmt.Errorf("invalid alert \"%s\" (total does not take a name)", s)
+	}
+
+	if i := strings.IndexByte(limit, ':'); i >= 0 {
+		n, err := strconv.Atoi(limit[i+1:])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid alert \"%s\" (invalid sample count)", s)
+		}
+		rule.count = n
+		limit = limit[:i]
+	}
+
+	threshold, err := parsePercent(limit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert \"%s\" (invalid threshold)", s)
+	}
+	rule.threshold = threshold
+
+	return rule, nil
+}
+
+// A group of threads exceeding an alert threshold
+type alertMatch struct {
+	rule    *alertRule
+	subject string
+	frac    float64
+	threads []*ThreadCPU
+	samples int
+}
+
+func (r *alertRule) matchName(name string) bool {
+	if r.name == "" {
+		return true
+	}
+	ok, _ := path.Match(r.name, name)
+	return ok
+}
+
+func (r *alertRule) evaluate(report *Report) []*alertMatch {
+	var matches []*alertMatch
+	switch r.scope {
+	case "thread":
+		for _, t := range report.Threads {
+			if r.matchName(t.Thread.Name) && t.Frac > r.threshold {
+				matches = append(matches, &alertMatch{r, t.Thread.TID, t.Frac, []*ThreadCPU{t}, 0})
+			}
+		}
+	case "pool":
+		pools := make(map[string][]*ThreadCPU)
+		for _, t := range report.Threads {
+			pool := poolName(t.Thread.Name)
+			if r.matchName(pool) {
+				pools[pool] = append(pools[pool], t)
+			}
+		}
+		for pool, threads := range pools {
+			var cpu time.Duration
+			for _, t := range threads {
+				cpu += t.CPU
+			}
+			frac := float64(cpu) / float64(report.Elapsed)
+			if frac > r.threshold {
+				matches = append(matches, &alertMatch{r, pool, frac, threads, 0})
+			}
+		}
+	case "total":
+		if report.TotalFrac > r.threshold {
+			matches = append(matches, &alertMatch{r, "total", report.TotalFrac, report.Threads, 0})
+		}
+	}
+	return matches
+}
+
+// Tracks how many consecutive samples each rule has matched each subject.
+type alertState struct {
+	rules   []*alertRule
+	streaks map[string]int
+}
+
+func newAlertState(rules []*alertRule) *alertState {
+	return &alertState{rules, make(map[string]int)}
+}
+
+// The number of samples needed to be sure whether any rule fires.
+func (s *alertState) samplesNeeded() int {
+	n := 1
+	for _, r := range s.rules {
+		if r.count > n {
+			n = r.count
+		}
+	}
+	return n
+}
+
+// Evaluate all rules against the next sample, returning any that fired.
+func (s *alertState) update(report *Report) []*alertMatch {
+	streaks := make(map[string]int)
+	var fired []*alertMatch
+	for _, r := range s.rules {
+		for _, m := range r.evaluate(report) {
+			key := r.text + "\x00" + m.subject
+			streaks[key] = s.streaks[key] + 1
+			m.samples = streaks[key]
+			if m.samples >= r.count {
+				fired = append(fired, m)
+			}
+		}
+	}
+	s.streaks = streaks
+	return fired
+}
+
+func writeAlerts(w io.Writer, report *Report, fired []*alertMatch) {
+	for _, m := range fired {
+		subject := m.subject
+		if m.rule.scope == "thread" {
+			subject = fmt.Sprintf("\"%s\"", m.threads[0].Thread.Name)
+		}
+		fmt.Fprintf(w, "ALERT %s: %s at %.2f%% for %d consecutive samples\n", m.rule.text, subject, 100*m.frac, m.samples)
+	}
+	fmt.Fprintln(w)
+
+	// Print each offending thread once, busiest first
+	seen := make(map[*ThreadCPU]bool)
+	offending := &Report{Elapsed: report.Elapsed}
+	for _, m := range fired {
+		for _, t := range m.threads {
+			if !seen[t] {
+				seen[t] = true
+				offending.Threads = append(offending.Threads, t)
+				offending.TotalCPU += t.CPU
+			}
+		}
+	}
+	offending.sortThreads()
+	offending.TotalFrac = float64(offending.TotalCPU) / float64(offending.Elapsed)
+	writeReport(w, offending, 0, false, true, nil, nil)
+}
+
+// Print fired alerts and run the alert command (if any) with the same text on
+// its stdin.
+func reportAlerts(out io.Writer, report *Report, fired []*alertMatch, command string) error {
+	var buf bytes.Buffer
+	writeAlerts(&buf, report, fired)
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if command == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = &buf
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "JTOPTHREADS_ALERT="+fired[0].rule.text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("alert command failed: %w", err)
+	}
+	return nil
+}
+
+// Where to print fired alerts: with the report for text output, and on stderr
+// otherwise, so that pprof, HTML and table output never has text mixed in.
+func alertOutput(out io.Writer, opts *outputOptions) io.Writer {
+	if opts.format == "text" {
+		return out
+	}
+	return os.Stderr
+}
+
+// Sample the process repeatedly, with back-to-back windows of the given
+// duration, until an alert fires or enough samples have been taken to rule
+// them all out. Returns the process exit status.
+func runAlerts(ctx context.Context, out *os.File, pid int, duration time.Duration, copts collectOptions, state *alertState, opts *outputOptions, command string) (int, error) {
+	dump0, err := collectDump(ctx, pid, copts)
+	if err != nil {
+		return 1, err
+	}
+
+	var start time.Time
+	var report *Report
+	for i := 0; i < state.samplesNeeded(); i++ {
+		start = dump0.Time
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+			return 1, ctx.Err()
+		}
+		dump1, err := collectDump(ctx, pid, copts)
+		if err != nil {
+			return 1, err
+		}
+		report, err = NewReport(dump0, dump1)
+		if err != nil {
+			return 1, err
+		}
+		if fired := state.update(report); len(fired) > 0 {
+			if err := reportAlerts(alertOutput(out, opts), report, fired, command); err != nil {
+				return 1, err
+			}
+			return alertExitCode, nil
+		}
+		dump0 = dump1
+	}
+
+	return 0, printReport(out, report, start, opts)
+}
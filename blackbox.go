@@ -0,0 +1,329 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A ring buffer of recordings on disk. Samples are appended to the newest
+// segment, and the oldest segments are removed once the buffer spans more
+// than the window.
+type ringBuffer struct {
+	dir      string
+	window   time.Duration
+	segment  time.Duration
+	current  *Recorder
+	started  time.Time
+	segments []string
+}
+
+func newRingBuffer(dir string, window, segment time.Duration) (*ringBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// Pick up segments left by a previous run, so they are eventually removed
+	existing, err := filepath.Glob(filepath.Join(dir, "segment-*.rec"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(existing)
+	return &ringBuffer{dir: dir, window: window, segment: segment, segments: existing}, nil
+}
+
+func (b *ringBuffer) Add(dump *StackDump) error {
+	now := time.Now()
+	if b.current == nil || now.Sub(b.started) >= b.segment {
+		if err := b.rotate(now); err != nil {
+			return err
+		}
+	}
+	return b.current.Add(dump)
+}
+
+func (b *ringBuffer) rotate(now time.Time) error {
+	if b.current != nil {
+		if err := b.current.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Zero padded so segments sort by name in time order
+	path := filepath.Join(b.dir, fmt.Sprintf("segment-%020d.rec", now.UnixNano()))
+	r, err := OpenRecording(path)
+	if err != nil {
+		return err
+	}
+	b.current, b.started = r, now
+	b.segments = append(b.segments, path)
+
+	// Keep enough whole segments to cover the window, plus the current one
+	keep := int((b.window+b.segment-1)/b.segment) + 1
+	for len(b.segments) > keep {
+		if err := os.Remove(b.segments[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b.segments = b.segments[1:]
+	}
+	return nil
+}
+
+// Copy the buffered samples into a single recording at path.
+func (b *ringBuffer) snapshot(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	for _, segment := range b.segments {
+		data, err := ioutil.ReadFile(segment)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			out.Close()
+			return err
+		}
+		// Drop a partially written final line
+		if i := strings.LastIndexByte(string(data), '\n'); i >= 0 {
+			data = data[:i+1]
+		} else {
+			continue
+		}
+		if _, err := out.Write(data); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+func (b *ringBuffer) Close() error {
+	if b.current == nil {
+		return nil
+	}
+	return b.current.Close()
+}
+
+// A new snapshot file in dir, named after the current time.
+func snapshotPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("snapshot-%s.rec", time.Now().Format("20060102T150405.000")))
+}
+
+// A request to flush the buffer, with the reason for it. The path of the
+// snapshot (or an error) is sent on done, if set.
+type flushRequest struct {
+	reason string
+	done   chan<- flushResult
+}
+
+type flushResult struct {
+	path string
+	err  error
+}
+
+// Implements "jtopthreads blackbox", which continuously keeps the last few
+// minutes of /proc stats and thread dumps on disk, and writes them out as a
+// recording when asked to.
+func blackboxMain(args []string) {
+	fs := flag.NewFlagSet("blackbox", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s blackbox [options] <pid | main-class>\n\n", os.Args[0])
+		fmt.Fprintf(out, "Snapshots are written on SIGUSR1, when the trigger file is created, or on\n")
+		fmt.Fprintf(out, "POST /flush if -listen is given.\n\n")
+		fs.PrintDefaults()
+	}
+
+	dir := ""
+	window := 10 * time.Minute
+	segment := time.Minute
+	poll := time.Second
+	dumpInterval := time.Minute
+	triggerFile := ""
+	listen := ""
+
+	fs.StringVar(&dir, "dir", dir, "keep the ring buffer and snapshots in `directory` (default jtopthreads-blackbox-<pid>)")
+	fs.DurationVar(&window, "window", window, "keep at least `duration` of samples")
+	fs.DurationVar(&segment, "segment", segment, "start a new ring buffer segment every `duration`")
+	fs.DurationVar(&poll, "poll", poll, "sample /proc every `duration`")
+	fs.DurationVar(&dumpInterval, "dump-interval", dumpInterval, "take a thread dump every `duration`")
+	fs.StringVar(&triggerFile, "trigger-file", triggerFile, "write a snapshot (and remove the file) when `file` is created")
+	fs.StringVar(&listen, "listen", listen, "accept POST /flush on `address` (e.g. 127.0.0.1:9405)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || poll <= 0 || segment <= 0 || window <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	pid, err := parseJavaPID(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dir == "" {
+		dir = fmt.Sprintf("jtopthreads-blackbox-%d", pid)
+	}
+
+	buf, err := newRingBuffer(dir, window, segment)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer buf.Close()
+
+	flushCh := make(chan flushRequest)
+	// Closed once the recorder stops, after which flushes are refused
+	stopped := make(chan struct{})
+	defer close(stopped)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(flushSignals, os.Interrupt, syscall.SIGTERM)...)
+
+	if listen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "POST required", http.StatusMethodNotAllowed)
+				return
+			}
+			done := make(chan flushResult, 1)
+			select {
+			case flushCh <- flushRequest{"http request from " + r.RemoteAddr, done}:
+			case <-stopped:
+				http.Error(w, "recorder stopped", http.StatusServiceUnavailable)
+				return
+			}
+			res := <-done
+			if res.err != nil {
+				http.Error(w, res.err.Error(), http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, res.path+"\n")
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(listen, mux))
+		}()
+	}
+
+	flush := func(req flushRequest) {
+		// Include the state of the process right now, as that is most likely
+		// what prompted the flush
+		ctx, cancel := context.WithTimeout(context.Background(), defaultCollectOptions.timeout)
+		if dump, err := jstackContext(ctx, pid); err == nil {
+			if err := buf.Add(dump); err != nil {
+				log.Printf("error adding thread dump: %v", err)
+			}
+		} else {
+			log.Printf("warning: thread dump unavailable for snapshot: %v", err)
+		}
+		cancel()
+
+		path := snapshotPath(dir)
+		err := buf.snapshot(path)
+		if err != nil {
+			log.Printf("error writing snapshot: %v", err)
+		} else {
+			log.Printf("wrote snapshot %s (%s)", path, req.reason)
+		}
+		if req.done != nil {
+			req.done <- flushResult{path, err}
+		}
+	}
+
+	// Thread dumps are taken in the background, so that /proc is still
+	// sampled every poll while jstack is slow or hangs
+	type dumpResult struct {
+		dump *StackDump
+		err  error
+	}
+	dumpCh := make(chan dumpResult, 1)
+	dumping := false
+	var lastDump time.Time
+
+	log.Printf("recording %d to %s", pid, dir)
+	pollTicker := time.NewTicker(poll)
+	defer pollTicker.Stop()
+	for {
+		select {
+		case res := <-dumpCh:
+			dumping = false
+			if res.err != nil {
+				log.Printf("warning: thread dump failed: %v", res.err)
+			} else if err := buf.Add(res.dump); err != nil {
+				log.Printf("error adding thread dump: %v", err)
+			}
+			continue
+		case sig := <-signals:
+			if sig == os.Interrupt || sig == syscall.SIGTERM {
+				return
+			}
+			flush(flushRequest{reason: "signal " + sig.String()})
+			continue
+		case req := <-flushCh:
+			flush(req)
+			continue
+		case <-pollTicker.C:
+		}
+
+		if triggerFile != "" {
+			if _, err := os.Stat(triggerFile); err == nil {
+				if err := os.Remove(triggerFile); err != nil {
+					log.Printf("error removing trigger file: %v", err)
+				}
+				flush(flushRequest{reason: "trigger file " + triggerFile})
+			}
+		}
+
+		// Failed dumps are also only retried after the dump interval
+		if !dumping && time.Since(lastDump) >= dumpInterval {
+			dumping = true
+			lastDump = time.Now()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), defaultCollectOptions.timeout)
+				defer cancel()
+				dump, err := jstackContext(ctx, pid)
+				dumpCh <- dumpResult{dump, err}
+			}()
+		}
+
+		// If the process has exited (or samples can no longer be recorded),
+		// keep what led up to it
+		dump, err := readCompactProcDump(pid)
+		if err == nil {
+			err = buf.Add(dump)
+		}
+		if err != nil {
+			log.Printf("stopping: %v", err)
+			path := snapshotPath(dir)
+			if err := buf.snapshot(path); err != nil {
+				log.Printf("error writing snapshot: %v", err)
+			} else {
+				log.Printf("wrote snapshot %s (final)", path)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+// A capture bundle is a gzipped tar archive containing one or more samples
+// along with everything needed to interpret them on another host,
+//
+//	samples/<n>/threads.txt  thread dump text
+//	samples/<n>/stat         /proc/<pid>/stat and /proc/<pid>/task/*/stat lines
+//	manifest.json            BundleManifest
+//
+// The manifest is written last so samples can be streamed to disk as they are
+// collected.
+const bundleManifestName = "manifest.json"
+
+const bundleVersion = 1
+
+type BundleHost struct {
+	Hostname string `json:"hostname"`
+	Kernel   string `json:"kernel"`
+	Arch     string `json:"arch"`
+	NumCPU   int    `json:"num_cpu"`
+}
+
+type BundleSample struct {
+	Time   time.Time     `json:"time"`
+	End    time.Time     `json:"end"`
+	Uptime time.Duration `json:"uptime"`
+	Cgroup *CgroupCPU    `json:"cgroup,omitempty"`
+}
+
+type BundleManifest struct {
+	Version    int            `json:"version"`
+	PID        int            `json:"pid"`
+	ClkTck     int64          `json:"clk_tck"`
+	JVMVersion string         `json:"jvm_version"`
+	Host       BundleHost     `json:"host"`
+	Samples    []BundleSample `json:"samples"`
+}
+
+func currentHost() BundleHost {
+	host := BundleHost{Arch: runtime.GOARCH, NumCPU: runtime.NumCPU()}
+	host.Hostname, _ = os.Hostname()
+	if release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		host.Kernel = strings.TrimSpace(string(release))
+	}
+	return host
+}
+
+// Extract the JVM description from the "Full thread dump ..." line of a
+// thread dump.
+func jvmVersion(text string) string {
+	for _, l := range strings.Split(text, "\n") {
+		if strings.HasPrefix(l, "Full thread dump ") {
+			return strings.TrimSuffix(strings.TrimPrefix(l, "Full thread dump "), ":")
+		}
+	}
+	return ""
+}
+
+func isBundle(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+type BundleWriter struct {
+	file     *os.File
+	gz       *gzip.Writer
+	tar      *tar.Writer
+	manifest BundleManifest
+}
+
+func CreateBundle(path string, pid int) (*BundleWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &BundleWriter{
+		file: f,
+		gz:   gz,
+		tar:  tar.NewWriter(gz),
+		manifest: BundleManifest{
+			Version: bundleVersion,
+			PID:     pid,
+			ClkTck:  proc.ClockTicks(),
+			Host:    currentHost(),
+		},
+	}, nil
+}
+
+func (w *BundleWriter) writeFile(name string, data []byte, mtime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: mtime,
+	}
+	if err := w.tar.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.tar.Write(data)
+	return err
+}
+
+func (w *BundleWriter) Add(dump *StackDump) error {
+	n := len(w.manifest.Samples)
+	prefix := fmt.Sprintf("samples/%d/", n)
+
+	if err := w.writeFile(prefix+"threads.txt", []byte(dump.Text), dump.Time); err != nil {
+		return err
+	}
+
+	// Sort by ID for stable output
+	ids := make([]int, 0, len(dump.ProcStats))
+	for id := range dump.ProcStats {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var stat bytes.Buffer
+	for _, id := range ids {
+		stat.WriteString(strings.TrimSuffix(dump.ProcStats[id], "\n"))
+		stat.WriteByte('\n')
+	}
+	if err := w.writeFile(prefix+"stat", stat.Bytes(), dump.Time); err != nil {
+		return err
+	}
+
+	if w.manifest.JVMVersion == "" {
+		w.manifest.JVMVersion = jvmVersion(dump.Text)
+	}
+	w.manifest.Samples = append(w.manifest.Samples, BundleSample{dump.Time, dump.End, dump.Uptime, dump.Cgroup})
+	return nil
+}
+
+func (w *BundleWriter) Close() error {
+	manifest, err := json.MarshalIndent(&w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := w.writeFile(bundleManifestName, manifest, time.Now()); err != nil {
+		return err
+	}
+	if err := w.tar.Close(); err != nil {
+		return err
+	}
+	if err := w.gz.Close(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func parseStatLines(text string) (map[int]string, error) {
+	res := make(map[int]string)
+	for _, l := range strings.Split(text, "\n") {
+		if l == "" {
+			continue
+		}
+		end := strings.IndexByte(l, ' ')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid stat line \"%s\"", l)
+		}
+		id, err := strconv.Atoi(l[:end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid stat line \"%s\"", l)
+		}
+		res[id] = l
+	}
+	return res, nil
+}
+
+// Read all samples from a capture bundle, in capture order.
+func ReadBundle(path string) ([]*StackDump, *BundleManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[hdr.Name] = data
+	}
+
+	data, ok := files[bundleManifestName]
+	if !ok {
+		return nil, nil, errors.New("bundle manifest missing (incomplete capture?)")
+	}
+	manifest := &BundleManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+	if manifest.Version != bundleVersion {
+		return nil, nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	var dumps []*StackDump
+	for n, sample := range manifest.Samples {
+		prefix := fmt.Sprintf("samples/%d/", n)
+		text, ok := files[prefix+"threads.txt"]
+		if !ok {
+			return nil, nil, fmt.Errorf("bundle missing %sthreads.txt", prefix)
+		}
+		stats, err := parseStatLines(string(files[prefix+"stat"]))
+		if err != nil {
+			return nil, nil, err
+		}
+		dumps = append(dumps, &StackDump{
+			Text:      string(text),
+			PID:       manifest.PID,
+			ProcStats: stats,
+			Uptime:    sample.Uptime,
+			ClkTck:    manifest.ClkTck,
+			Time:      sample.Time,
+			End:       sample.End,
+			Cgroup:    sample.Cgroup,
+		})
+	}
+
+	return dumps, manifest, nil
+}
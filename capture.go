@@ -0,0 +1,80 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Implements "jtopthreads capture", which writes samples of a live process to
+// a bundle for later analysis (possibly on another host).
+func captureMain(args []string) {
+	fs := flag.NewFlagSet("capture", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s capture [options] <pid | main-class>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	output := ""
+	count := 2
+	interval := 5 * time.Second
+
+	fs.StringVar(&output, "o", output, "write bundle to `file` (default jtopthreads-<pid>-<time>.tar.gz)")
+	fs.IntVar(&count, "count", count, "capture `N` samples")
+	fs.DurationVar(&interval, "interval", interval, "wait `duration` between samples")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || count < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	pid, err := parseJavaPID(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("jtopthreads-%d-%s.tar.gz", pid, time.Now().Format("20060102T150405"))
+	}
+
+	w, err := CreateBundle(output, pid)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		dump, err := jstack(pid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := w.Add(dump); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d samples to %s\n", count, output)
+}
@@ -0,0 +1,359 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CPU limits and throttling counters of the cgroup a process belongs to.
+type CgroupCPU struct {
+	// cgroup version (1 or 2) and path of the cgroup within the hierarchy
+	Version int    `json:"version"`
+	Path    string `json:"path"`
+
+	// The tightest CFS quota in the cgroup's hierarchy as a number of CPUs, or
+	// zero if unlimited.
+	Quota float64 `json:"quota"`
+
+	// Number of CPUs the process may run on (its cpuset)
+	CPUs int `json:"cpus"`
+
+	// Cumulative throttling counters from cpu.stat
+	Periods       uint64        `json:"nr_periods"`
+	Throttled     uint64        `json:"nr_throttled"`
+	ThrottledTime time.Duration `json:"throttled_time"`
+}
+
+// The number of CPUs available to the process and what limits it.
+func (c *CgroupCPU) Available() (float64, string) {
+	if c.Quota > 0 && (c.CPUs == 0 || c.Quota < float64(c.CPUs)) {
+		return c.Quota, "cgroup quota"
+	}
+	return float64(c.CPUs), "cpuset"
+}
+
+// A cgroup hierarchy mounted on this host.
+type cgroupMount struct {
+	root        string
+	mountPoint  string
+	version     int
+	controllers map[string]bool
+}
+
+func readCgroupMounts() ([]*cgroupMount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []*cgroupMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// From proc(5), e.g.
+		//
+		//   36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+3 >= len(fields) {
+			continue
+		}
+		mount := &cgroupMount{root: fields[3], mountPoint: fields[4], controllers: make(map[string]bool)}
+		switch fields[sep+1] {
+		case "cgroup":
+			mount.version = 1
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				mount.controllers[opt] = true
+			}
+		case "cgroup2":
+			mount.version = 2
+		default:
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// Find the directory for the cgroup at path in the hierarchy with the given
+// version (and controller for version 1).
+func cgroupDir(mounts []*cgroupMount, version int, controller string, path string) string {
+	for _, m := range mounts {
+		if m.version != version || (version == 1 && !m.controllers[controller]) {
+			continue
+		}
+		rel := path
+		if m.root != "/" {
+			if path != m.root && !strings.HasPrefix(path, m.root+"/") {
+				continue
+			}
+			rel = strings.TrimPrefix(path, m.root)
+		}
+		return filepath.Join(m.mountPoint, rel)
+	}
+	return ""
+}
+
+func readCgroupFile(dir, name string) (string, error) {
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(bytes)), err
+}
+
+// Count the CPUs in a list such as "0-3,8,10-11".
+func countCPUList(list string) (int, error) {
+	n := 0
+	for _, r := range strings.Split(strings.TrimSpace(list), ",") {
+		if r == "" {
+			continue
+		}
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		l, err := strconv.Atoi(lo)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cpu list \"%s\"", list)
+		}
+		h, err := strconv.Atoi(hi)
+		if err != nil || h < l {
+			return 0, fmt.Errorf("invalid cpu list \"%s\"", list)
+		}
+		n += h - l + 1
+	}
+	return n, nil
+}
+
+// Parse the "key value" lines of cpu.stat.
+func parseCPUStat(text string) map[string]uint64 {
+	stat := make(map[string]uint64)
+	for _, l := range strings.Split(text, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) == 2 {
+			if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				stat[fields[0]] = v
+			}
+		}
+	}
+	return stat
+}
+
+// Walk from dir up to the hierarchy's mount point, returning the tightest
+// quota found by quota (as a number of CPUs).
+func hierarchyQuota(dir, mountPoint string, quota func(dir string) float64) float64 {
+	min := 0.0
+	for {
+		if q := quota(dir); q > 0 && (min == 0 || q < min) {
+			min = q
+		}
+		if dir == mountPoint || len(dir) <= len(mountPoint) {
+			return min
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func cgroupMountPoint(mounts []*cgroupMount, dir string) string {
+	best := ""
+	for _, m := range mounts {
+		if strings.HasPrefix(dir, m.mountPoint) && len(m.mountPoint) > len(best) {
+			best = m.mountPoint
+		}
+	}
+	return best
+}
+
+// Read the CPU limits of the process's cgroup. Returns nil if the process's
+// cgroup cannot be determined (e.g. on systems without cgroups).
+func readCgroupCPU(pid int) (*CgroupCPU, error) {
+	bytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	mounts, err := readCgroupMounts()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Each line is hierarchy-ID:controller-list:cgroup-path. The v1 cpu
+	// controller takes precedence on hybrid hosts.
+	paths := make(map[string]string)
+	for _, l := range strings.Split(strings.TrimSpace(string(bytes)), "\n") {
+		parts := strings.SplitN(l, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths["v2"] = parts[2]
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			paths[c] = parts[2]
+		}
+	}
+
+	cg := &CgroupCPU{}
+	if path, ok := paths["cpu"]; ok && cgroupDir(mounts, 1, "cpu", path) != "" {
+		dir := cgroupDir(mounts, 1, "cpu", path)
+		cg.Version, cg.Path = 1, path
+		cg.Quota = hierarchyQuota(dir, cgroupMountPoint(mounts, dir), func(dir string) float64 {
+			quota, err1 := readCgroupFile(dir, "cpu.cfs_quota_us")
+			period, err2 := readCgroupFile(dir, "cpu.cfs_period_us")
+			if err1 != nil || err2 != nil {
+				return 0
+			}
+			return quotaCPUs(quota, period)
+		})
+		if text, err := readCgroupFile(dir, "cpu.stat"); err == nil {
+			stat := parseCPUStat(text)
+			cg.Periods = stat["nr_periods"]
+			cg.Throttled = stat["nr_throttled"]
+			cg.ThrottledTime = time.Duration(stat["throttled_time"])
+		}
+		if path, ok := paths["cpuset"]; ok {
+			if dir := cgroupDir(mounts, 1, "cpuset", path); dir != "" {
+				for _, name := range []string{"cpuset.effective_cpus", "cpuset.cpus"} {
+					if text, err := readCgroupFile(dir, name); err == nil && text != "" {
+						cg.CPUs, _ = countCPUList(text)
+						break
+					}
+				}
+			}
+		}
+	} else if path, ok := paths["v2"]; ok && cgroupDir(mounts, 2, "", path) != "" {
+		dir := cgroupDir(mounts, 2, "", path)
+		cg.Version, cg.Path = 2, path
+		cg.Quota = hierarchyQuota(dir, cgroupMountPoint(mounts, dir), func(dir string) float64 {
+			max, err := readCgroupFile(dir, "cpu.max")
+			if err != nil {
+				return 0
+			}
+			fields := strings.Fields(max)
+			if len(fields) != 2 {
+				return 0
+			}
+			return quotaCPUs(fields[0], fields[1])
+		})
+		if text, err := readCgroupFile(dir, "cpu.stat"); err == nil {
+			stat := parseCPUStat(text)
+			cg.Periods = stat["nr_periods"]
+			cg.Throttled = stat["nr_throttled"]
+			cg.ThrottledTime = time.Duration(stat["throttled_usec"]) * time.Microsecond
+		}
+		if text, err := readCgroupFile(dir, "cpuset.cpus.effective"); err == nil && text != "" {
+			cg.CPUs, _ = countCPUList(text)
+		}
+	} else {
+		return nil, nil
+	}
+
+	// Fall back to the process's CPU affinity, which reflects its cpuset
+	if cg.CPUs == 0 {
+		cg.CPUs, _ = readAllowedCPUs(pid)
+	}
+	return cg, nil
+}
+
+// Convert a quota and period in microseconds to a number of CPUs. Returns
+// zero for "max" (v2) or -1 (v1), meaning unlimited.
+func quotaCPUs(quota, period string) float64 {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return float64(q) / float64(p)
+}
+
+// Count the CPUs in the process's affinity mask.
+func readAllowedCPUs(pid int) (int, error) {
+	bytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range strings.Split(string(bytes), "\n") {
+		if strings.HasPrefix(l, "Cpus_allowed_list:") {
+			return countCPUList(strings.TrimPrefix(l, "Cpus_allowed_list:"))
+		}
+	}
+	return 0, nil
+}
+
+// CPU available to the process over a report window, and the throttling it
+// incurred.
+type CPULimit struct {
+	CPUs   float64
+	Source string
+	// The cgroup the limit applies to
+	Path string
+
+	// Throttling within the window, if it was measured at both ends
+	Periods       uint64
+	Throttled     uint64
+	ThrottledTime time.Duration
+}
+
+func newCPULimit(cg0, cg1 *CgroupCPU) *CPULimit {
+	if cg1 == nil {
+		return nil
+	}
+	cpus, source := cg1.Available()
+	if cpus <= 0 {
+		return nil
+	}
+	limit := &CPULimit{CPUs: cpus, Source: source, Path: cg1.Path}
+	if cg0 != nil && cg0.Path == cg1.Path && cg1.Periods >= cg0.Periods && cg1.Throttled >= cg0.Throttled {
+		limit.Periods = cg1.Periods - cg0.Periods
+		limit.Throttled = cg1.Throttled - cg0.Throttled
+		limit.ThrottledTime = cg1.ThrottledTime - cg0.ThrottledTime
+	}
+	return limit
+}
+
+// Describes the report's usage of the available CPU, e.g.
+//
+//	Available CPU (2 CPUs by cgroup quota, throttled in 12 of 50 periods for 340ms)
+func (l *CPULimit) String() string {
+	unit := "CPUs"
+	if l.CPUs == 1 {
+		unit = "CPU"
+	}
+	s := fmt.Sprintf("Available CPU (%g %s by %s", l.CPUs, unit, l.Source)
+	if l.Periods > 0 {
+		s += fmt.Sprintf(", throttled in %d of %d periods for %s", l.Throttled, l.Periods, l.ThrottledTime.Round(time.Millisecond))
+	}
+	return s + ")"
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// A thread which started or exited between the two dumps of a report.
+type ThreadChange struct {
+	Thread *Thread
+	// CPU used within the report window. For exited threads this is unknown,
+	// since their usage after the first dump is never observed, and is zero.
+	CPU time.Duration
+	// For created threads, the exited thread whose tid or nid was reused.
+	Reuses *Thread
+}
+
+// Record threads only present in the first dump as exited, and link created
+// threads to exited threads whose tid or nid they reuse.
+func (r *Report) findExited(threads0, threads1 map[string]*Thread) {
+	byTID := make(map[string]*Thread)
+	byNID := make(map[int]*Thread)
+	for key, t0 := range threads0 {
+		if _, ok := threads1[key]; !ok {
+			r.Exited = append(r.Exited, &ThreadChange{Thread: t0})
+			byTID[t0.TID] = t0
+			byNID[t0.NID] = t0
+		}
+	}
+	for _, c := range r.Created {
+		if t0, ok := byTID[c.Thread.TID]; ok {
+			c.Reuses = t0
+		} else if t0, ok := byNID[c.Thread.NID]; ok {
+			c.Reuses = t0
+		}
+	}
+	r.sortChurn()
+}
+
+// Sort created threads by CPU and exited threads by key.
+func (r *Report) sortChurn() {
+	sort.Slice(r.Created, func(i, j int) bool {
+		if r.Created[i].CPU == r.Created[j].CPU {
+			return r.Created[i].Thread.key() < r.Created[j].Thread.key()
+		}
+		return r.Created[i].CPU > r.Created[j].CPU
+	})
+	sort.Slice(r.Exited, func(i, j int) bool {
+		return r.Exited[i].Thread.key() < r.Exited[j].Thread.key()
+	})
+}
+
+// Threads created and exited within a single pool.
+type PoolChurn struct {
+	Pool    string
+	Created int
+	Exited  int
+}
+
+// Thread churn per pool, busiest pools first.
+func (r *Report) Churn() []*PoolChurn {
+	pools := make(map[string]*PoolChurn)
+	get := func(t *Thread) *PoolChurn {
+		name := poolName(t.Name)
+		p, ok := pools[name]
+		if !ok {
+			p = &PoolChurn{Pool: name}
+			pools[name] = p
+		}
+		return p
+	}
+	for _, c := range r.Created {
+		get(c.Thread).Created++
+	}
+	for _, c := range r.Exited {
+		get(c.Thread).Exited++
+	}
+
+	var churn []*PoolChurn
+	for _, p := range pools {
+		churn = append(churn, p)
+	}
+	sort.Slice(churn, func(i, j int) bool {
+		ci, cj := churn[i].Created+churn[i].Exited, churn[j].Created+churn[j].Exited
+		if ci == cj {
+			return churn[i].Pool < churn[j].Pool
+		}
+		return ci > cj
+	})
+	return churn
+}
+
+// Per second rate of n events over the report window.
+func (r *Report) rate(n int) float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(n) / r.Elapsed.Seconds()
+}
+
+func threadLabel(t *Thread) string {
+	label := fmt.Sprintf("\"%s\"", t.Name)
+	if t.JavaID != "" {
+		label += " " + t.JavaID
+	}
+	return fmt.Sprintf("%s tid=%s nid=0x%x", label, t.TID, t.NID)
+}
+
+// Write the threads created and exited within the report window (at most n of
+// each if n is positive) and the churn per pool.
+func writeChurn(w io.Writer, report *Report, n int) {
+	if len(report.Created) == 0 && len(report.Exited) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Threads created: %d, exited: %d\n", len(report.Created), len(report.Exited))
+	for i, c := range report.Created {
+		if n > 0 && i >= n {
+			fmt.Fprintf(w, "  ... %d more created\n", len(report.Created)-n)
+			break
+		}
+		fmt.Fprintf(w, "  created %s cpu=%s", threadLabel(c.Thread), c.CPU)
+		if c.Reuses != nil {
+			fmt.Fprintf(w, " (reuses tid/nid of exited %s)", threadLabel(c.Reuses))
+		}
+		fmt.Fprintln(w)
+	}
+	for i, c := range report.Exited {
+		if n > 0 && i >= n {
+			fmt.Fprintf(w, "  ... %d more exited\n", len(report.Exited)-n)
+			break
+		}
+		fmt.Fprintf(w, "  exited  %s cpu=unknown (%s in total at first dump)\n", threadLabel(c.Thread), c.Thread.CPU)
+	}
+
+	fmt.Fprintf(w, "Thread churn by pool (per second over %s):\n", report.Elapsed)
+	for _, p := range report.Churn() {
+		fmt.Fprintf(w, "  %s: created %d (%.2f/s), exited %d (%.2f/s)\n",
+			p.Pool, p.Created, report.rate(p.Created), p.Exited, report.rate(p.Exited))
+	}
+	fmt.Fprintln(w)
+}
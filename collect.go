@@ -0,0 +1,175 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type collectOptions struct {
+	// Time limit for each jstack attempt
+	timeout time.Duration
+	// Number of times to retry a failed jstack
+	retries int
+	// Run jstack -l, which adds the java.util.concurrent locks held by each
+	// thread ("Locked ownable synchronizers") at some extra cost
+	locks bool
+}
+
+var defaultCollectOptions = collectOptions{
+	timeout: 30 * time.Second,
+	retries: 2,
+}
+
+// Take a thread dump, retrying with exponential backoff on failure. Gives up
+// early if ctx is done.
+func collectDump(ctx context.Context, pid int, copts collectOptions) (*StackDump, error) {
+	var args []string
+	if copts.locks {
+		args = append(args, "-l")
+	}
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, copts.timeout)
+		dump, err := jstackContext(attemptCtx, pid, args...)
+		cancel()
+		if err == nil {
+			return dump, nil
+		}
+		if attempt >= copts.retries || ctx.Err() != nil {
+			if attempt > 0 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt+1)
+			}
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// A pair of stack dumps. If one of the dumps could not be collected, Partial
+// describes the failure and the other dump is compared against an empty dump
+// (i.e. usage is reported since each thread started).
+type Sample struct {
+	Dump0   *StackDump
+	Dump1   *StackDump
+	Partial string
+}
+
+func (s *Sample) Report() (*Report, error) {
+	report, err := NewReport(s.Dump0, s.Dump1)
+	if err != nil {
+		return nil, err
+	}
+	report.Partial = s.Partial
+	return report, nil
+}
+
+// Take a pair of stack dumps from the process, duration apart. If duration is
+// zero a single dump is taken and compared against an empty dump so usage is
+// reported since each thread started. An error is only returned if no dump
+// could be collected at all.
+func sampleProcess(ctx context.Context, pid int, duration time.Duration, copts collectOptions) (*Sample, error) {
+	if duration <= 0 {
+		dump, err := collectDump(ctx, pid, copts)
+		if err != nil {
+			return nil, err
+		}
+		return &Sample{Dump0: &StackDump{}, Dump1: dump}, nil
+	}
+
+	type result struct {
+		dump *StackDump
+		err  error
+	}
+
+	ch0 := make(chan result, 1)
+	go func() {
+		dump, err := collectDump(ctx, pid, copts)
+		ch0 <- result{dump, err}
+	}()
+
+	ch1 := make(chan result, 1)
+	go func() {
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+			ch1 <- result{nil, ctx.Err()}
+			return
+		}
+		dump, err := collectDump(ctx, pid, copts)
+		ch1 <- result{dump, err}
+	}()
+
+	r0, r1 := <-ch0, <-ch1
+	switch {
+	case r0.err != nil && r1.err != nil:
+		return nil, r0.err
+	case r0.err != nil:
+		return &Sample{
+			Dump0:   &StackDump{},
+			Dump1:   r1.dump,
+			Partial: fmt.Sprintf("first sample failed (%v), showing usage since thread start", r0.err),
+		}, nil
+	case r1.err != nil:
+		return &Sample{
+			Dump0:   &StackDump{},
+			Dump1:   r0.dump,
+			Partial: fmt.Sprintf("second sample failed (%v), showing usage since thread start", r1.err),
+		}, nil
+	default:
+		return &Sample{Dump0: r0.dump, Dump1: r1.dump}, nil
+	}
+}
+
+// The time thread CPU times were most likely read at (the midpoint of the
+// capture) and the duration of the capture.
+func (dump *StackDump) captureTime() (time.Time, time.Duration) {
+	if dump.End.Before(dump.Time) {
+		return dump.Time, 0
+	}
+	d := dump.End.Sub(dump.Time)
+	return dump.Time.Add(d / 2), d
+}
+
+// Use the interval between the two captures, rather than each thread's own
+// elapsed time, as the denominator for all fractions. The thread dump does not
+// say when in the capture CPU times were read, so the interval is measured
+// between the midpoints of the captures and may be off by half the duration
+// of each.
+func (r *Report) useCaptureTimes(dump0, dump1 *StackDump) {
+	t0, d0 := dump0.captureTime()
+	t1, d1 := dump1.captureTime()
+	interval := t1.Sub(t0)
+	if interval <= 0 {
+		return
+	}
+
+	r.Elapsed = interval
+	r.Capture = [2]time.Duration{d0, d1}
+	r.Skew = (d0 + d1) / 2
+	for _, t := range r.Threads {
+		t.Frac = float64(t.CPU) / float64(interval)
+	}
+	r.sortThreads()
+	r.TotalFrac = float64(r.TotalCPU) / float64(interval)
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Threads with identical (normalized) stacks.
+type stackGroup struct {
+	// The busiest thread, with CPU summed over the group
+	*ThreadCPU
+	Threads []*ThreadCPU
+	MaxFrac float64
+}
+
+// Group the report's threads by process and normalized stack, in descending
+// order of summed CPU. Threads without a stack (e.g. GC threads) are grouped
+// by pool instead, so that only threads doing the same job are merged.
+func groupStacks(report *Report) []*stackGroup {
+	byKey := make(map[string]*stackGroup)
+	var groups []*stackGroup
+	for _, t := range report.Threads {
+		key := t.Process + "\x00" + normalizeStack(t.Thread.Stack)
+		if t.Thread.Stack == "" {
+			key += "\x00" + poolName(t.Thread.Name)
+		}
+		g := byKey[key]
+		if g == nil {
+			// Threads are in descending order of CPU, so the first is the busiest
+			g = &stackGroup{ThreadCPU: &ThreadCPU{Thread: t.Thread, Process: t.Process, Prev: t.Prev}}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.Threads = append(g.Threads, t)
+		g.CPU += t.CPU
+		if t.Elapsed > g.Elapsed {
+			g.Elapsed = t.Elapsed
+		}
+		if t.Frac > g.MaxFrac {
+			g.MaxFrac = t.Frac
+		}
+	}
+	for _, g := range groups {
+		// Summed per-thread fractions, as threads may have started part way
+		// through the window
+		for _, t := range g.Threads {
+			g.Frac += t.Frac
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Frac > groups[j].Frac
+	})
+	return groups
+}
+
+// The number of thread names listed for each stack group.
+const groupNames = 5
+
+// Write the report with each distinct stack shown once, under the header of
+// its busiest thread and with the summed CPU of the threads sharing it. At
+// most n stacks are shown if n is positive.
+func writeDedupedReport(w io.Writer, report *Report, n int, summary bool, tty bool, lines *lineFormat, stacks *stackOptions) {
+	groups := groupStacks(report)
+	if n > 0 && n < len(groups) {
+		groups = groups[:n]
+	}
+	threads := make([]*ThreadCPU, len(groups))
+	for i, g := range groups {
+		threads[i] = g.ThreadCPU
+	}
+	i := 0
+	writeThreads(w, threads, tty, lines, func(t *ThreadCPU) {
+		g := groups[i]
+		i++
+		if len(g.Threads) > 1 {
+			var names []string
+			for _, t := range g.Threads {
+				if len(names) == groupNames {
+					names = append(names, fmt.Sprintf("and %d more", len(g.Threads)-groupNames))
+					break
+				}
+				names = append(names, t.Thread.Name)
+			}
+			fmt.Fprintf(w, "   %d threads, cpu %s, max %.2f%%: %s\n",
+				len(g.Threads), g.CPU.Round(time.Millisecond), 100*g.MaxFrac, strings.Join(names, ", "))
+		}
+		if !summary {
+			if len(t.Thread.Stack) > 0 {
+				fmt.Fprintln(w, stacks.apply(t.Thread.Stack))
+			}
+			fmt.Fprintln(w)
+		}
+	})
+	writeFooter(w, report, n, tty)
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// How a thread's stack changed between two dumps.
+const (
+	stackUnchanged   = "unchanged"
+	stackSameTop     = "same top frame"
+	stackDifferent   = "different call path"
+	stackNoPrevious  = "not in first dump"
+	stackNotCompared = "no stack to compare"
+)
+
+// Classify the change in a thread's stack between two dumps. A thread whose
+// stack never changes while using CPU is most likely spinning in one loop.
+// Stacks are compared after normalizing synthetic names (see normalizeName).
+func stackChange(prev, cur *Thread) string {
+	if prev == nil {
+		return stackNoPrevious
+	}
+	if prev.Stack == "" || cur.Stack == "" {
+		return stackNotCompared
+	}
+	if normalizeStack(prev.Stack) == normalizeStack(cur.Stack) {
+		return stackUnchanged
+	}
+	f0, f1 := prev.Frames(), cur.Frames()
+	if len(f0) > 0 && len(f1) > 0 && normalizeName(f0[0].Method) == normalizeName(f1[0].Method) {
+		return stackSameTop
+	}
+	return stackDifferent
+}
+
+// Compute a line diff of a and b using their longest common subsequence,
+// comparing lines by key. Each returned line is prefixed with ' ', '-' or '+',
+// and unchanged lines are taken from b.
+func diffLines(a, b []string, key func(string) string) []string {
+	ka, kb := make([]string, len(a)), make([]string, len(b))
+	for i, l := range a {
+		ka[i] = key(l)
+	}
+	for j, l := range b {
+		kb[j] = key(l)
+	}
+
+	// lcs[i][j] is the length of the LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if ka[i] == kb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case ka[i] == kb[j]:
+			out = append(out, " "+b[j])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
+
+// Write the report with how each thread's state and stack changed between the
+// two dumps in place of its stack. Changed stacks are shown as a unified diff
+// from the first dump to the second, comparing lines after normalization (so
+// that e.g. lock addresses don't show as changes) but showing them as dumped.
+// Stacks are
+// classified in full, and shortened using stacks (if set) only for display.
+func writeDiffReport(w io.Writer, report *Report, n int, summary bool, tty bool, lines *lineFormat, stacks *stackOptions) {
+	writeThreads(w, report.Top(n), tty, lines, func(t *ThreadCPU) {
+		change := stackChange(t.Prev, t.Thread)
+		label := change
+		if t.Prev != nil && t.Prev.State != t.Thread.State {
+			label += fmt.Sprintf(", state %s -> %s", t.Prev.State, t.Thread.State)
+		}
+		fmt.Fprintf(w, "   stack: %s\n", label)
+		if summary {
+			return
+		}
+
+		switch change {
+		case stackUnchanged, stackNoPrevious, stackNotCompared:
+			if len(t.Thread.Stack) > 0 {
+				fmt.Fprintln(w, stacks.apply(t.Thread.Stack))
+			}
+		default:
+			fmt.Fprintln(w, "--- first dump")
+			fmt.Fprintln(w, "+++ second dump")
+			prev, cur := stacks.apply(t.Prev.Stack), stacks.apply(t.Thread.Stack)
+			for _, l := range diffLines(strings.Split(prev, "\n"), strings.Split(cur, "\n"), normalizeName) {
+				fmt.Fprintln(w, l)
+			}
+		}
+		fmt.Fprintln(w)
+	})
+	writeFooter(w, report, n, tty)
+}
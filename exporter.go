@@ -0,0 +1,323 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+type poolKey struct {
+	pool  string
+	state string
+}
+
+// Exporter state for a single target JVM. Per-thread CPU is polled cheaply
+// from /proc and attributed to pools using the thread names from the most
+// recent thread dump.
+type exporterTarget struct {
+	name string
+	pid  int
+	// Start time of the process, in ticks since boot
+	start uint64
+
+	// utime+stime, in ticks, for each task as of the last poll
+	ticks map[int]uint64
+
+	// Threads from the last thread dump, by nid
+	threads  map[int]*Thread
+	lastDump time.Time
+	// When a thread dump was last attempted, successfully or not
+	lastAttempt time.Time
+
+	pools  *poolLimiter
+	cpu    map[poolKey]float64
+	count  map[poolKey]int
+	errors int
+}
+
+type exporter struct {
+	targets      []*exporterTarget
+	interval     time.Duration
+	dumpInterval time.Duration
+
+	mu sync.Mutex
+}
+
+func (t *exporterTarget) key(tid int, stat *proc.ProcStat) poolKey {
+	if thread, ok := t.threads[tid]; ok {
+		state := thread.State
+		if state == "" {
+			state = "UNKNOWN"
+		}
+		return poolKey{t.pools.pool(thread.Name), state}
+	}
+	// Not in the last thread dump (native thread or started since the last
+	// dump), so fall back to the truncated name from /proc.
+	return poolKey{t.pools.pool(stat.Comm), "UNKNOWN"}
+}
+
+// The start time of the process in ticks since boot, or zero if it is not
+// running.
+func processStart(pid int) uint64 {
+	bytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	stat, err := proc.Parse(string(bytes))
+	if err != nil {
+		return 0
+	}
+	return stat.Starttime
+}
+
+func (e *exporter) poll(t *exporterTarget) error {
+	// Resolving a main-class runs jps, so the pid is only resolved again once
+	// the process has exited or been replaced
+	pid, start := t.pid, processStart(t.pid)
+	if pid == 0 || start == 0 || start != t.start {
+		var err error
+		pid, err = parseJavaPID(t.name)
+		if err != nil {
+			return err
+		}
+		start = processStart(pid)
+	}
+	lastDump := t.lastDump
+	if pid != t.pid || start != t.start {
+		// New process (or first poll)
+		t.pid = pid
+		t.start = start
+		t.ticks = make(map[int]uint64)
+		t.threads = nil
+		t.lastAttempt = time.Time{}
+		lastDump = time.Time{}
+	}
+
+	if time.Since(t.lastAttempt) >= e.dumpInterval {
+		t.lastAttempt = time.Now()
+		// A failed dump is not retried until the next dump interval, and the
+		// names from the previous dump are kept, so that /proc metrics are
+		// still collected promptly while the JVM is unresponsive
+		threads, err := e.dumpThreads(pid)
+		if err != nil {
+			log.Printf("%s: thread dump failed, using thread names from the previous dump: %v", t.name, err)
+			e.mu.Lock()
+			t.errors++
+			e.mu.Unlock()
+		} else {
+			t.threads = threads
+			lastDump = t.lastAttempt
+		}
+	}
+
+	lines, err := collectProcStats(pid)
+	if err != nil {
+		return err
+	}
+	// Parse everything before updating the counters, so an error leaves them
+	// consistent with t.ticks
+	stats := make(map[int]*proc.ProcStat)
+	for tid, line := range lines {
+		// The entry for the pid is the process as a whole
+		if tid == pid {
+			continue
+		}
+		stat, err := proc.Parse(line)
+		if err != nil {
+			return err
+		}
+		stats[tid] = stat
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	t.lastDump = lastDump
+	ticks := make(map[int]uint64)
+	t.count = make(map[poolKey]int)
+	for tid, stat := range stats {
+		key := t.key(tid, stat)
+		now := stat.Utime + stat.Stime
+		// Threads we have not seen before are charged their full lifetime
+		// CPU so the counter reflects all CPU since each thread started.
+		if prev, ok := t.ticks[tid]; ok && prev <= now {
+			t.cpu[key] += proc.Duration(now - prev).Seconds()
+		} else {
+			t.cpu[key] += proc.Duration(now).Seconds()
+		}
+		t.count[key]++
+		ticks[tid] = now
+	}
+	t.ticks = ticks
+	return nil
+}
+
+// Take a thread dump, returning its threads by nid.
+func (e *exporter) dumpThreads(pid int) (map[int]*Thread, error) {
+	dump, err := jstack(pid)
+	if err != nil {
+		return nil, err
+	}
+	threads, err := dump.ParseThreads()
+	if err != nil {
+		return nil, err
+	}
+	byNID := make(map[int]*Thread)
+	for _, thread := range threads {
+		byNID[thread.NID] = thread
+	}
+	return byNID, nil
+}
+
+func (e *exporter) run(t *exporterTarget) {
+	for {
+		if err := e.poll(t); err != nil {
+			log.Printf("%s: %v", t.name, err)
+			e.mu.Lock()
+			t.errors++
+			e.mu.Unlock()
+		}
+		time.Sleep(e.interval)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetric(w io.Writer, name string, labels []string, value float64) {
+	fmt.Fprint(w, name)
+	if len(labels) > 0 {
+		fmt.Fprint(w, "{")
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		fmt.Fprint(w, "}")
+	}
+	fmt.Fprintf(w, " %g\n", value)
+}
+
+func sortedKeys(m map[poolKey]float64) []poolKey {
+	keys := make([]poolKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pool == keys[j].pool {
+			return keys[i].state < keys[j].state
+		}
+		return keys[i].pool < keys[j].pool
+	})
+	return keys
+}
+
+func (e *exporter) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP jvm_thread_cpu_seconds_total CPU time consumed by JVM threads, by thread pool and state.")
+	fmt.Fprintln(w, "# TYPE jvm_thread_cpu_seconds_total counter")
+	for _, t := range e.targets {
+		for _, k := range sortedKeys(t.cpu) {
+			writeMetric(w, "jvm_thread_cpu_seconds_total", []string{"target", t.name, "pool", k.pool, "state", k.state}, t.cpu[k])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP jvm_threads Number of live JVM threads, by thread pool and state.")
+	fmt.Fprintln(w, "# TYPE jvm_threads gauge")
+	for _, t := range e.targets {
+		counts := make(map[poolKey]float64)
+		for k, n := range t.count {
+			counts[k] = float64(n)
+		}
+		for _, k := range sortedKeys(counts) {
+			writeMetric(w, "jvm_threads", []string{"target", t.name, "pool", k.pool, "state", k.state}, counts[k])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP jtopthreads_last_dump_timestamp_seconds Time of the last successful thread dump.")
+	fmt.Fprintln(w, "# TYPE jtopthreads_last_dump_timestamp_seconds gauge")
+	for _, t := range e.targets {
+		if !t.lastDump.IsZero() {
+			writeMetric(w, "jtopthreads_last_dump_timestamp_seconds", []string{"target", t.name}, float64(t.lastDump.UnixNano())/1e9)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP jtopthreads_poll_errors_total Number of failed polls.")
+	fmt.Fprintln(w, "# TYPE jtopthreads_poll_errors_total counter")
+	for _, t := range e.targets {
+		writeMetric(w, "jtopthreads_poll_errors_total", []string{"target", t.name}, float64(t.errors))
+	}
+}
+
+// Implements "jtopthreads exporter", which publishes per-pool thread CPU
+// usage as Prometheus metrics.
+func exporterMain(args []string) {
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s exporter [options] <pid | main-class>...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	e := &exporter{
+		interval:     5 * time.Second,
+		dumpInterval: time.Minute,
+	}
+	listen := "127.0.0.1:9404"
+	maxPools := 100
+
+	fs.StringVar(&listen, "listen", listen, "listen on `address`")
+	fs.DurationVar(&e.interval, "interval", e.interval, "poll /proc every `duration`")
+	fs.DurationVar(&e.dumpInterval, "dump-interval", e.dumpInterval, "refresh thread names with a thread dump every `duration`")
+	fs.IntVar(&maxPools, "max-pools", maxPools, "report at most `N` distinct pools per target, grouping the rest as \"other\"")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	for _, name := range fs.Args() {
+		t := &exporterTarget{
+			name:  name,
+			pools: newPoolLimiter(maxPools),
+			cpu:   make(map[poolKey]float64),
+		}
+		e.targets = append(e.targets, t)
+		go e.run(t)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", e.handleMetrics)
+
+	log.Printf("listening on %s", listen)
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Controls how stacks are shortened for display.
+type stackOptions struct {
+	// Show at most depth frames (counting each folded run as one), if positive
+	depth int
+	// Fold runs of frames from these packages (and their subpackages)
+	hide []string
+	// If set, fold runs of frames from any other packages
+	app []string
+	// Fold consecutive repetitions of the same sequence of frames
+	recursion bool
+}
+
+func (s *stackOptions) enabled() bool {
+	return s.depth > 0 || len(s.hide) > 0 || len(s.app) > 0 || s.recursion
+}
+
+// Register the flags which set s.
+func (s *stackOptions) addFlags(fs *flag.FlagSet) {
+	fs.IntVar(&s.depth, "depth", s.depth, "show at most `N` frames of each stack")
+	fs.Var((*packagesFlag)(&s.hide), "hide-packages", "fold runs of frames from the comma separated `packages`, e.g.\nio.netty,java.lang.reflect")
+	fs.Var((*packagesFlag)(&s.app), "app-packages", "show only frames from the comma separated `packages`, folding all others")
+	fs.BoolVar(&s.recursion, "fold-recursion", s.recursion, "fold repeated sequences of frames (e.g. from recursion)")
+}
+
+// A comma separated list of package names.
+type packagesFlag []string
+
+func (f *packagesFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *packagesFlag) Set(value string) error {
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*f = append(*f, p)
+		}
+	}
+	return nil
+}
+
+// The first of packages which contains pkg, or "" if none do.
+func matchPackage(pkg string, packages []string) string {
+	for _, p := range packages {
+		if pkg == p || strings.HasPrefix(pkg, p+".") {
+			return p
+		}
+	}
+	return ""
+}
+
+// A line of a stack. Lines which are not frames (the thread state, and lock
+// details such as "- locked <...>") have a nil frame.
+type stackLine struct {
+	text  string
+	frame *Frame
+	// Number of frames represented, if this is a folded run
+	folded int
+}
+
+func (l *stackLine) frames() int {
+	if l.folded > 0 {
+		return l.folded
+	}
+	if l.frame != nil {
+		return 1
+	}
+	return 0
+}
+
+// Shorten a stack for display, replacing folded frames with lines such as
+//
+//	... 12 frames in io.netty ...
+//
+// Only stacks being printed are shortened; comparisons and aggregations use
+// the full stacks. s may be nil.
+func (s *stackOptions) apply(stack string) string {
+	if s == nil || !s.enabled() {
+		return stack
+	}
+	var lines []*stackLine
+	for _, text := range strings.Split(stack, "\n") {
+		line := &stackLine{text: text}
+		if frame, ok := parseFrame(text); ok {
+			line.frame = &frame
+		}
+		lines = append(lines, line)
+	}
+
+	if s.recursion {
+		lines = foldRecursion(lines)
+	}
+	if len(s.app) > 0 {
+		lines = foldRuns(lines, 1, func(f *Frame) string {
+			if matchPackage(f.Package(), s.app) != "" {
+				return ""
+			}
+			return "non-application"
+		}, func(n int, _ string) string {
+			return fmt.Sprintf("... %s ...", plural(n, "non-application frame"))
+		})
+	}
+	if len(s.hide) > 0 {
+		lines = foldRuns(lines, 2, func(f *Frame) string {
+			return matchPackage(f.Package(), s.hide)
+		}, func(n int, pkg string) string {
+			return fmt.Sprintf("... %d frames in %s ...", n, pkg)
+		})
+	}
+	if s.depth > 0 {
+		lines = limitDepth(lines, s.depth)
+	}
+
+	var b strings.Builder
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(l.text)
+	}
+	return b.String()
+}
+
+// Replace each run of at least min consecutive frames with the same non-empty
+// group with a single line, given by describe.
+func foldRuns(lines []*stackLine, min int, group func(f *Frame) string, describe func(n int, group string) string) []*stackLine {
+	var res []*stackLine
+	for i := 0; i < len(lines); {
+		g := ""
+		if lines[i].frame != nil {
+			g = group(lines[i].frame)
+		}
+		j := i + 1
+		for g != "" && j < len(lines) && lines[j].frame != nil && group(lines[j].frame) == g {
+			j++
+		}
+		if g == "" || j-i < min {
+			res = append(res, lines[i:j]...)
+		} else {
+			res = append(res, &stackLine{text: "\t" + describe(j-i, g), folded: j - i})
+		}
+		i = j
+	}
+	return res
+}
+
+// Longest sequence of frames considered when folding recursion.
+const maxRecursionPeriod = 32
+
+// Replace repetitions of a sequence of frames with a single copy followed by
+// a count of the repetitions removed, preferring the fold which removes the
+// most frames.
+func foldRecursion(lines []*stackLine) []*stackLine {
+	var res []*stackLine
+	for i := 0; i < len(lines); {
+		bestPeriod, bestRepeats := 0, 0
+		for period := 1; period <= maxRecursionPeriod && i+2*period <= len(lines); period++ {
+			repeats := 0
+			for start := i + period; start+period <= len(lines) && sameFrames(lines[i:i+period], lines[start:start+period]); start += period {
+				repeats++
+			}
+			if repeats > 0 && period*repeats > bestPeriod*bestRepeats {
+				bestPeriod, bestRepeats = period, repeats
+			}
+		}
+		if bestRepeats == 0 {
+			res = append(res, lines[i])
+			i++
+			continue
+		}
+		res = append(res, lines[i:i+bestPeriod]...)
+		frames := "frame"
+		if bestPeriod > 1 {
+			frames = plural(bestPeriod, "frame")
+		}
+		text := fmt.Sprintf("\t... previous %s repeated %s ...", frames, plural(bestRepeats, "more time"))
+		res = append(res, &stackLine{text: text, folded: bestPeriod * bestRepeats})
+		i += bestPeriod * (bestRepeats + 1)
+	}
+	return res
+}
+
+// Format a count of things, e.g. "1 frame" or "3 frames".
+func plural(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+// Whether a and b are the same sequence of frames, and contain only frames.
+func sameFrames(a, b []*stackLine) bool {
+	for i := range a {
+		if a[i].frame == nil || b[i].frame == nil || a[i].text != b[i].text {
+			return false
+		}
+	}
+	return true
+}
+
+// Keep lines up to the depth'th frame (or folded run), followed by a count of
+// the frames removed.
+func limitDepth(lines []*stackLine, depth int) []*stackLine {
+	shown := 0
+	for i, l := range lines {
+		if l.frames() == 0 {
+			continue
+		}
+		if shown == depth {
+			removed := 0
+			for _, r := range lines[i:] {
+				removed += r.frames()
+			}
+			return append(lines[:i:i], &stackLine{text: fmt.Sprintf("\t... %s ...", plural(removed, "more frame"))})
+		}
+		shown++
+	}
+	return lines
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+type htmlThread struct {
+	*ThreadCPU
+	Pool string
+	// The stack as shown, which may be shortened
+	Stack string
+}
+
+// CPU usage summed over a group of threads (a pool, or the threads running a
+// method).
+type htmlGroup struct {
+	Name    string
+	Threads int
+	CPU     time.Duration
+	Frac    float64
+}
+
+type htmlReport struct {
+	Title   string
+	Start   time.Time
+	Elapsed time.Duration
+	Threads []htmlThread
+	Multi   bool
+	Pools   []*htmlGroup
+	Self    []*htmlGroup
+	Total   []*htmlGroup
+	Footer  string
+}
+
+// Sum the CPU of the threads in each group, returning the groups with CPU
+// usage in descending order.
+func sumGroups(threads []*ThreadCPU, elapsed time.Duration, groups func(t *ThreadCPU) []string) []*htmlGroup {
+	byName := make(map[string]*htmlGroup)
+	var res []*htmlGroup
+	for _, t := range threads {
+		for _, name := range groups(t) {
+			g := byName[name]
+			if g == nil {
+				g = &htmlGroup{Name: name}
+				byName[name] = g
+				res = append(res, g)
+			}
+			g.Threads++
+			g.CPU += t.CPU
+		}
+	}
+	for _, g := range res {
+		g.Frac = float64(g.CPU) / float64(elapsed)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].CPU == res[j].CPU {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].CPU > res[j].CPU
+	})
+	return res
+}
+
+// Write the n busiest threads in the report as a standalone HTML page, with
+// all of the threads summed by pool and by method. Methods are ranked by the CPU of
+// the threads they are at the top of (self) and anywhere in the stack of
+// (total), after normalizing synthetic class names. Stacks are shortened using
+// stacks, if set, for display only.
+func writeHTML(w io.Writer, report *Report, n int, start time.Time, stacks *stackOptions) error {
+	threads := report.Top(n)
+	data := &htmlReport{
+		Title:   "jtopthreads",
+		Start:   start,
+		Elapsed: report.Elapsed.Round(time.Millisecond),
+	}
+	for _, t := range threads {
+		data.Threads = append(data.Threads, htmlThread{t, poolName(t.Thread.Name), stacks.apply(t.Thread.Stack)})
+		data.Multi = data.Multi || t.Process != ""
+	}
+	if len(report.Processes) == 1 {
+		data.Title += " " + report.Processes[0].Label
+	}
+
+	data.Pools = sumGroups(report.Threads, report.Elapsed, func(t *ThreadCPU) []string {
+		pool := poolName(t.Thread.Name)
+		if t.Process != "" {
+			pool = t.Process + " " + pool
+		}
+		return []string{pool}
+	})
+	data.Self = sumGroups(report.Threads, report.Elapsed, func(t *ThreadCPU) []string {
+		if frames := t.Thread.Frames(); len(frames) > 0 {
+			return []string{normalizeName(frames[0].Method)}
+		}
+		return nil
+	})
+	data.Total = sumGroups(report.Threads, report.Elapsed, func(t *ThreadCPU) []string {
+		// Count recursive methods once per thread
+		var methods []string
+		seen := make(map[string]bool)
+		for _, f := range t.Thread.Frames() {
+			method := normalizeName(f.Method)
+			if !seen[method] {
+				seen[method] = true
+				methods = append(methods, method)
+			}
+		}
+		return methods
+	})
+
+	var footer bytes.Buffer
+	writeFooter(&footer, report, n, true)
+	data.Footer = footer.String()
+
+	return htmlTemplate.Execute(w, data)
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(frac float64) string {
+		return fmt.Sprintf("%.2f%%", 100*frac)
+	},
+	// A sort key for the fraction, which is NaN if nothing elapsed
+	"sortable": func(frac float64) float64 {
+		if math.IsNaN(frac) || math.IsInf(frac, 0) {
+			return 0
+		}
+		return frac
+	},
+	"seconds": func(d time.Duration) float64 {
+		return d.Seconds()
+	},
+	"groups": func(label string, groups []*htmlGroup) interface{} {
+		return struct {
+			Label  string
+			Groups []*htmlGroup
+		}{label, groups}
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}{{if not .Start.IsZero}} {{.Start.Format "2006-01-02 15:04:05 MST"}}{{end}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1.5em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { padding: 2px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; cursor: pointer; user-select: none; }
+tr:nth-child(even) > td { background: #f8f8f8; }
+td.num, th.num { text-align: right; font-variant-numeric: tabular-nums; }
+pre { margin: 0.3em 0 0.3em 1em; font-size: 12px; }
+summary { cursor: pointer; }
+code, pre { font-family: monospace; }
+#search { width: 30em; margin-bottom: 1em; }
+details.aggregate { margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{if not .Start.IsZero}}Sampled at {{.Start.Format "2006-01-02 15:04:05 MST"}}, e{{else}}E{{end}}lapsed {{.Elapsed}}</p>
+<pre>{{.Footer}}</pre>
+
+<h2>Threads</h2>
+<input id="search" type="search" placeholder="Filter by name, state or stack">
+<table id="threads" class="sortable">
+<thead><tr>
+<th class="num" data-type="num">CPU</th>
+<th class="num" data-type="num">CPU time (s)</th>
+<th>State</th>
+{{if .Multi}}<th>Process</th>{{end}}
+<th>Pool</th>
+<th>Thread</th>
+</tr></thead>
+<tbody>
+{{range .Threads}}<tr>
+<td class="num" data-value="{{sortable .Frac}}">{{percent .Frac}}</td>
+<td class="num" data-value="{{seconds .CPU}}">{{printf "%.3f" (seconds .CPU)}}</td>
+<td>{{.Thread.State}}</td>
+{{if $.Multi}}<td>{{.Process}}</td>{{end}}
+<td>{{.Pool}}</td>
+<td>{{if .Stack}}<details><summary>{{.Thread.Name}}</summary><pre>{{.Thread.Header}}
+{{.Stack}}</pre></details>{{else}}{{.Thread.Name}}{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+
+{{define "groups"}}<table class="sortable">
+<thead><tr>
+<th class="num" data-type="num">CPU</th>
+<th class="num" data-type="num">CPU time (s)</th>
+<th class="num" data-type="num">Threads</th>
+<th>{{.Label}}</th>
+</tr></thead>
+<tbody>
+{{range .Groups}}<tr>
+<td class="num" data-value="{{sortable .Frac}}">{{percent .Frac}}</td>
+<td class="num" data-value="{{seconds .CPU}}">{{printf "%.3f" (seconds .CPU)}}</td>
+<td class="num" data-value="{{.Threads}}">{{.Threads}}</td>
+<td><code>{{.Name}}</code></td>
+</tr>
+{{end}}</tbody>
+</table>{{end}}
+
+<h2>Pools</h2>
+{{template "groups" (groups "Pool" .Pools)}}
+
+<h2>Methods</h2>
+<details class="aggregate" open><summary>By top of stack (self)</summary>
+{{template "groups" (groups "Method" .Self)}}
+</details>
+<details class="aggregate"><summary>Anywhere in stack (total)</summary>
+{{template "groups" (groups "Method" .Total)}}
+</details>
+
+<script>
+document.querySelectorAll("table.sortable").forEach(function(table) {
+  table.querySelectorAll("th").forEach(function(th, col) {
+    var desc = th.dataset.type === "num";
+    th.addEventListener("click", function() {
+      var body = table.tBodies[0];
+      var rows = Array.from(body.rows);
+      var key = function(row) {
+        var cell = row.cells[col];
+        return th.dataset.type === "num" ? parseFloat(cell.dataset.value) : cell.textContent.trim().toLowerCase();
+      };
+      rows.sort(function(a, b) {
+        var x = key(a), y = key(b);
+        return (x < y ? -1 : x > y ? 1 : 0) * (desc ? -1 : 1);
+      });
+      desc = !desc;
+      rows.forEach(function(row) { body.appendChild(row); });
+    });
+  });
+});
+document.getElementById("search").addEventListener("input", function(e) {
+  var q = e.target.value.toLowerCase();
+  Array.from(document.getElementById("threads").tBodies[0].rows).forEach(function(row) {
+    row.style.display = row.textContent.toLowerCase().indexOf(q) >= 0 ? "" : "none";
+  });
+});
+</script>
+</body>
+</html>
+`))
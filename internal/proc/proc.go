@@ -82,7 +82,16 @@ func Parse(s string) (*ProcStat, error) {
 	return stat, nil
 }
 
+// Number of clock ticks per second (_SC_CLK_TCK) on this host.
+func ClockTicks() int64 {
+	return scClkTck()
+}
+
 func Duration(v uint64) time.Duration {
-	tck := scClkTck()
+	return DurationTicks(v, scClkTck())
+}
+
+// Like Duration, but for values read on a host with the given tick rate.
+func DurationTicks(v uint64, tck int64) time.Duration {
 	return time.Second * time.Duration(v) / time.Duration(tck)
 }
@@ -0,0 +1,732 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Support for reading Java Flight Recorder recordings (JDK 11+ chunk format,
+// version 2). Recordings are self-describing: each chunk carries metadata
+// describing the layout of every event and constant pool type, so we decode
+// values generically and then pick out the handful of events we care about,
+//
+//	jdk.ExecutionSample   sampled Java stacks
+//	jdk.ThreadCPULoad     periodic per-thread CPU usage
+//	jdk.ThreadStart/End   thread lifetimes
+//	jdk.CPUInformation    number of hardware threads (to scale CPU load)
+//	jdk.ActiveSetting     sampling period (used if CPU load is unavailable)
+
+var jfrMagic = []byte("FLR\x00")
+
+const jfrHeaderSize = 68
+
+func isJFR(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(jfrMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, jfrMagic)
+}
+
+type jfrReader struct {
+	data       []byte
+	pos        int
+	compressed bool
+	err        error
+}
+
+func (r *jfrReader) fail(format string, a ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("jfr: "+format, a...)
+	}
+	r.pos = len(r.data)
+}
+
+func (r *jfrReader) raw(n int) []byte {
+	if n < 0 || r.pos+n > len(r.data) {
+		r.fail("unexpected end of data")
+		return make([]byte, n)
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *jfrReader) byte() byte {
+	return r.raw(1)[0]
+}
+
+// JFR's variable length encoding is LEB128, except the ninth byte (if
+// reached) contributes all eight of its bits.
+func (r *jfrReader) varint() int64 {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		b := r.byte()
+		v |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			return int64(v)
+		}
+	}
+	v |= uint64(r.byte()) << 56
+	return int64(v)
+}
+
+func (r *jfrReader) short() int64 {
+	if r.compressed {
+		return r.varint()
+	}
+	return int64(int16(binary.BigEndian.Uint16(r.raw(2))))
+}
+
+func (r *jfrReader) int() int64 {
+	if r.compressed {
+		return r.varint()
+	}
+	return int64(int32(binary.BigEndian.Uint32(r.raw(4))))
+}
+
+func (r *jfrReader) long() int64 {
+	if r.compressed {
+		return r.varint()
+	}
+	return int64(binary.BigEndian.Uint64(r.raw(8)))
+}
+
+// Read a count, checking it against the remaining data so corrupt input
+// cannot trigger huge allocations.
+func (r *jfrReader) count() int {
+	n := r.int()
+	if n < 0 || n > int64(len(r.data)-r.pos) {
+		r.fail("invalid count %d", n)
+		return 0
+	}
+	return int(n)
+}
+
+// A reference to an entry in a constant pool
+type jfrRef struct {
+	typeID int64
+	key    int64
+}
+
+// Strings may be stored inline or as a reference to the string pool.
+func (r *jfrReader) string(stringType int64) interface{} {
+	switch enc := r.byte(); enc {
+	case 0:
+		return nil
+	case 1:
+		return ""
+	case 2:
+		return jfrRef{stringType, r.long()}
+	case 3, 5:
+		return string(r.raw(r.count()))
+	case 4:
+		n := r.count()
+		runes := make([]rune, n)
+		for i := range runes {
+			runes[i] = rune(r.short())
+		}
+		return string(runes)
+	default:
+		r.fail("unknown string encoding %d", enc)
+		return nil
+	}
+}
+
+type jfrField struct {
+	name   string
+	typeID int64
+	cp     bool
+	array  bool
+}
+
+type jfrClass struct {
+	id     int64
+	name   string
+	super  string
+	fields []jfrField
+}
+
+type jfrElement struct {
+	name     string
+	attrs    map[string]string
+	children []*jfrElement
+}
+
+func (r *jfrReader) element(strs []string) *jfrElement {
+	str := func() string {
+		i := r.int()
+		if i < 0 || i >= int64(len(strs)) {
+			r.fail("invalid string index %d", i)
+			return ""
+		}
+		return strs[i]
+	}
+
+	e := &jfrElement{name: str(), attrs: make(map[string]string)}
+	for n := r.count(); n > 0; n-- {
+		k := str()
+		e.attrs[k] = str()
+	}
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		e.children = append(e.children, r.element(strs))
+	}
+	return e
+}
+
+// A single chunk of a recording. Values are decoded into int64, float64,
+// bool, string, jfrRef, map[string]interface{} (for objects) and
+// []interface{} (for arrays).
+type jfrChunk struct {
+	startNanos     int64
+	durationNanos  int64
+	startTicks     int64
+	ticksPerSecond int64
+
+	classes    map[int64]*jfrClass
+	byName     map[string]*jfrClass
+	stringType int64
+	pools      map[int64]map[int64]interface{}
+}
+
+func (c *jfrChunk) time(ticks int64) time.Time {
+	nanos := float64(ticks-c.startTicks) * 1e9 / float64(c.ticksPerSecond)
+	return time.Unix(0, c.startNanos+int64(nanos))
+}
+
+func (c *jfrChunk) value(r *jfrReader, typeID int64) interface{} {
+	class, ok := c.classes[typeID]
+	if !ok {
+		r.fail("unknown type %d", typeID)
+		return nil
+	}
+
+	switch class.name {
+	case "boolean":
+		return r.byte() != 0
+	case "byte":
+		return int64(int8(r.byte()))
+	case "char", "short":
+		return r.short()
+	case "int":
+		return r.int()
+	case "long":
+		return r.long()
+	case "float":
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(r.raw(4))))
+	case "double":
+		return math.Float64frombits(binary.BigEndian.Uint64(r.raw(8)))
+	case "java.lang.String":
+		return r.string(c.stringType)
+	}
+
+	obj := make(map[string]interface{}, len(class.fields))
+	for _, f := range class.fields {
+		if r.err != nil {
+			return nil
+		}
+		if f.array {
+			n := r.count()
+			arr := make([]interface{}, n)
+			for i := range arr {
+				arr[i] = c.fieldValue(r, f)
+			}
+			obj[f.name] = arr
+		} else {
+			obj[f.name] = c.fieldValue(r, f)
+		}
+	}
+	return obj
+}
+
+func (c *jfrChunk) fieldValue(r *jfrReader, f jfrField) interface{} {
+	if f.cp {
+		return jfrRef{f.typeID, r.long()}
+	}
+	return c.value(r, f.typeID)
+}
+
+// Follow constant pool references until reaching a concrete value.
+func (c *jfrChunk) resolve(v interface{}) interface{} {
+	for i := 0; i < 8; i++ {
+		ref, ok := v.(jfrRef)
+		if !ok {
+			return v
+		}
+		v = c.pools[ref.typeID][ref.key]
+	}
+	return nil
+}
+
+func (c *jfrChunk) get(v interface{}, path ...string) interface{} {
+	v = c.resolve(v)
+	for _, name := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = c.resolve(obj[name])
+	}
+	return v
+}
+
+func (c *jfrChunk) getString(v interface{}, path ...string) string {
+	s, _ := c.get(v, path...).(string)
+	return s
+}
+
+func (c *jfrChunk) getInt(v interface{}, path ...string) int64 {
+	n, _ := c.get(v, path...).(int64)
+	return n
+}
+
+func (c *jfrChunk) getFloat(v interface{}, path ...string) float64 {
+	n, _ := c.get(v, path...).(float64)
+	return n
+}
+
+func (c *jfrChunk) readMetadata(r *jfrReader) {
+	r.int() // size
+	if typeID := r.long(); typeID != 0 {
+		r.fail("expected metadata event, found type %d", typeID)
+		return
+	}
+	r.long() // start time
+	r.long() // duration
+	r.long() // metadata ID
+
+	strs := make([]string, r.count())
+	for i := range strs {
+		s, _ := r.string(0).(string)
+		strs[i] = s
+	}
+
+	root := r.element(strs)
+	if r.err != nil {
+		return
+	}
+
+	for _, m := range root.children {
+		if m.name != "metadata" {
+			continue
+		}
+		for _, e := range m.children {
+			if e.name != "class" {
+				continue
+			}
+			id, err := strconv.ParseInt(e.attrs["id"], 10, 64)
+			if err != nil {
+				r.fail("invalid class id \"%s\"", e.attrs["id"])
+				return
+			}
+			class := &jfrClass{id: id, name: e.attrs["name"], super: e.attrs["superType"]}
+			for _, f := range e.children {
+				if f.name != "field" {
+					continue
+				}
+				typeID, err := strconv.ParseInt(f.attrs["class"], 10, 64)
+				if err != nil {
+					r.fail("invalid field class \"%s\"", f.attrs["class"])
+					return
+				}
+				class.fields = append(class.fields, jfrField{
+					name:   f.attrs["name"],
+					typeID: typeID,
+					cp:     f.attrs["constantPool"] == "true",
+					array:  f.attrs["dimension"] == "1",
+				})
+			}
+			c.classes[id] = class
+			c.byName[class.name] = class
+		}
+	}
+
+	if s, ok := c.byName["java.lang.String"]; ok {
+		c.stringType = s.id
+	}
+}
+
+func (c *jfrChunk) readConstantPool(r *jfrReader) int64 {
+	r.int() // size
+	if typeID := r.long(); typeID != 1 {
+		r.fail("expected constant pool event, found type %d", typeID)
+		return 0
+	}
+	r.long() // start time
+	r.long() // duration
+	delta := r.long()
+	r.byte() // flush
+
+	for n := r.count(); n > 0 && r.err == nil; n-- {
+		typeID := r.long()
+		pool, ok := c.pools[typeID]
+		if !ok {
+			pool = make(map[int64]interface{})
+			c.pools[typeID] = pool
+		}
+		for m := r.count(); m > 0 && r.err == nil; m-- {
+			key := r.long()
+			pool[key] = c.value(r, typeID)
+		}
+	}
+	return delta
+}
+
+type jfrEvent struct {
+	chunk  *jfrChunk
+	class  *jfrClass
+	fields map[string]interface{}
+}
+
+func (e *jfrEvent) time() time.Time {
+	return e.chunk.time(e.chunk.getInt(e.fields, "startTime"))
+}
+
+// Parse a single chunk, calling fn for each event of interest.
+func readJFRChunk(data []byte, interesting map[string]bool, fn func(e *jfrEvent)) (*jfrChunk, error) {
+	hdr := &jfrReader{data: data}
+	hdr.raw(len(jfrMagic))
+	major := binary.BigEndian.Uint16(hdr.raw(2))
+	hdr.raw(2) // minor
+	if major != 2 {
+		return nil, fmt.Errorf("jfr: unsupported version %d (JDK 11 or newer required)", major)
+	}
+
+	chunkSize := int64(binary.BigEndian.Uint64(hdr.raw(8)))
+	cpOffset := int64(binary.BigEndian.Uint64(hdr.raw(8)))
+	metaOffset := int64(binary.BigEndian.Uint64(hdr.raw(8)))
+	c := &jfrChunk{
+		startNanos:     int64(binary.BigEndian.Uint64(hdr.raw(8))),
+		durationNanos:  int64(binary.BigEndian.Uint64(hdr.raw(8))),
+		startTicks:     int64(binary.BigEndian.Uint64(hdr.raw(8))),
+		ticksPerSecond: int64(binary.BigEndian.Uint64(hdr.raw(8))),
+		classes:        make(map[int64]*jfrClass),
+		byName:         make(map[string]*jfrClass),
+		pools:          make(map[int64]map[int64]interface{}),
+	}
+	features := binary.BigEndian.Uint32(hdr.raw(4))
+	if hdr.err != nil {
+		return nil, hdr.err
+	}
+	if chunkSize > int64(len(data)) || metaOffset >= chunkSize || cpOffset >= chunkSize || c.ticksPerSecond <= 0 {
+		return nil, errors.New("jfr: invalid chunk header (incomplete recording?)")
+	}
+
+	data = data[:chunkSize]
+	compressed := features&1 != 0
+
+	r := &jfrReader{data: data, pos: int(metaOffset), compressed: compressed}
+	c.readMetadata(r)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Constant pools are chained backwards from the last one
+	for offset := cpOffset; offset > 0; {
+		r = &jfrReader{data: data, pos: int(offset), compressed: compressed}
+		delta := c.readConstantPool(r)
+		if r.err != nil {
+			return nil, r.err
+		}
+		if delta == 0 || offset+delta <= 0 || offset+delta >= chunkSize {
+			break
+		}
+		offset += delta
+	}
+
+	r = &jfrReader{data: data, pos: jfrHeaderSize, compressed: compressed}
+	for r.pos < len(data) && r.err == nil {
+		start := r.pos
+		size := r.int()
+		if size <= 0 || int64(start)+size > int64(len(data)) {
+			return nil, fmt.Errorf("jfr: invalid event size %d at offset %d", size, start)
+		}
+		typeID := r.long()
+		if class, ok := c.classes[typeID]; ok && interesting[class.name] {
+			fields, _ := c.value(r, typeID).(map[string]interface{})
+			if r.err != nil {
+				return nil, r.err
+			}
+			fn(&jfrEvent{c, class, fields})
+		}
+		r.pos = start + int(size)
+	}
+
+	return c, r.err
+}
+
+// Per-thread data accumulated from a recording
+type jfrThread struct {
+	javaID  int64
+	osID    int64
+	name    string
+	start   time.Time
+	end     time.Time
+	cpu     time.Duration
+	hasLoad bool
+	lastCPU time.Time
+	samples int
+	stacks  map[string]int
+	states  map[string]int
+}
+
+// Java class names are recorded in internal form (e.g. java/lang/Thread).
+// Hidden classes keep their "/0x..." suffix, as printed by jstack.
+func jfrClassName(name string) string {
+	suffix := ""
+	if i := strings.Index(name, "/0x"); i >= 0 {
+		name, suffix = name[:i], name[i:]
+	}
+	return strings.ReplaceAll(name, "/", ".") + suffix
+}
+
+func (c *jfrChunk) formatStack(stackTrace interface{}) string {
+	var b strings.Builder
+	frames, _ := c.get(stackTrace, "frames").([]interface{})
+	for _, f := range frames {
+		class := jfrClassName(c.getString(f, "method", "type", "name", "string"))
+		method := c.getString(f, "method", "name", "string")
+		line := c.getInt(f, "lineNumber")
+		if line > 0 {
+			fmt.Fprintf(&b, "\tat %s.%s(Unknown Source:%d)\n", class, method, line)
+		} else {
+			fmt.Fprintf(&b, "\tat %s.%s(Unknown Source)\n", class, method)
+		}
+	}
+	if truncated, _ := c.get(stackTrace, "truncated").(bool); truncated {
+		b.WriteString("\t...\n")
+	}
+	return b.String()
+}
+
+func parseJFRPeriod(s string) time.Duration {
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Read a recording, producing a thread per Java thread seen. Thread CPU is
+// taken from jdk.ThreadCPULoad events where available and otherwise
+// estimated from the number of execution samples. Each thread's stack is its
+// most frequently sampled stack.
+func ReadJFR(path string) (map[string]*Thread, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	interesting := map[string]bool{
+		"jdk.ExecutionSample": true,
+		"jdk.ThreadCPULoad":   true,
+		"jdk.ThreadStart":     true,
+		"jdk.ThreadEnd":       true,
+		"jdk.CPUInformation":  true,
+		"jdk.ActiveSetting":   true,
+	}
+
+	threads := make(map[int64]*jfrThread)
+	var recStart, recEnd time.Time
+	hwThreads := int64(0)
+	samplePeriod := time.Duration(0)
+
+	thread := func(c *jfrChunk, v interface{}) *jfrThread {
+		id := c.getInt(v, "javaThreadId")
+		if c.get(v) == nil || id == 0 {
+			return nil
+		}
+		t, ok := threads[id]
+		if !ok {
+			t = &jfrThread{javaID: id, stacks: make(map[string]int), states: make(map[string]int)}
+			threads[id] = t
+		}
+		if name := c.getString(v, "javaName"); name != "" {
+			t.name = name
+		}
+		if osID := c.getInt(v, "osThreadId"); osID != 0 {
+			t.osID = osID
+		}
+		return t
+	}
+
+	type cpuLoad struct {
+		thread *jfrThread
+		time   time.Time
+		load   float64
+	}
+	var loads []cpuLoad
+
+	for len(data) > 0 {
+		if !bytes.HasPrefix(data, jfrMagic) {
+			return nil, errors.New("jfr: invalid chunk magic")
+		}
+		c, err := readJFRChunk(data, interesting, func(e *jfrEvent) {
+			switch e.class.name {
+			case "jdk.ExecutionSample":
+				if t := thread(e.chunk, e.fields["sampledThread"]); t != nil {
+					t.samples++
+					t.stacks[e.chunk.formatStack(e.fields["stackTrace"])]++
+					state := strings.TrimPrefix(e.chunk.getString(e.fields["state"], "name"), "STATE_")
+					t.states[state]++
+				}
+			case "jdk.ThreadCPULoad":
+				if t := thread(e.chunk, e.fields["eventThread"]); t != nil {
+					load := e.chunk.getFloat(e.fields["user"]) + e.chunk.getFloat(e.fields["system"])
+					loads = append(loads, cpuLoad{t, e.time(), load})
+				}
+			case "jdk.ThreadStart":
+				if t := thread(e.chunk, e.fields["thread"]); t != nil {
+					t.start = e.time()
+				}
+			case "jdk.ThreadEnd":
+				if t := thread(e.chunk, e.fields["thread"]); t != nil {
+					t.end = e.time()
+				}
+			case "jdk.CPUInformation":
+				hwThreads = e.chunk.getInt(e.fields["hwThreads"])
+			case "jdk.ActiveSetting":
+				sample, ok := e.chunk.byName["jdk.ExecutionSample"]
+				if ok && e.chunk.getInt(e.fields["id"]) == sample.id && e.chunk.getString(e.fields["name"]) == "period" {
+					if d := parseJFRPeriod(e.chunk.getString(e.fields["value"])); d > 0 {
+						samplePeriod = d
+					}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		start := time.Unix(0, c.startNanos)
+		end := start.Add(time.Duration(c.durationNanos))
+		if recStart.IsZero() || start.Before(recStart) {
+			recStart = start
+		}
+		if end.After(recEnd) {
+			recEnd = end
+		}
+
+		size := int(binary.BigEndian.Uint64(data[8:16]))
+		data = data[size:]
+	}
+
+	if hwThreads <= 0 {
+		hwThreads = 1
+	}
+	if samplePeriod <= 0 {
+		samplePeriod = 20 * time.Millisecond
+	}
+
+	// CPU load is reported as a fraction of all hardware threads over the
+	// period since the thread's previous load event.
+	sort.Slice(loads, func(i, j int) bool { return loads[i].time.Before(loads[j].time) })
+	for _, l := range loads {
+		t := l.thread
+		since := t.lastCPU
+		if since.IsZero() {
+			since = recStart
+			if t.start.After(since) {
+				since = t.start
+			}
+		}
+		if l.time.After(since) {
+			t.cpu += time.Duration(l.load * float64(hwThreads) * float64(l.time.Sub(since)))
+		}
+		t.lastCPU = l.time
+		t.hasLoad = true
+	}
+
+	res := make(map[string]*Thread)
+	for _, t := range threads {
+		start, end := recStart, recEnd
+		if t.start.After(start) {
+			start = t.start
+		}
+		if !t.end.IsZero() && t.end.Before(end) {
+			end = t.end
+		}
+
+		cpu := t.cpu
+		if !t.hasLoad {
+			cpu = time.Duration(t.samples) * samplePeriod
+		}
+
+		stack, stackCount := "", 0
+		for s, n := range t.stacks {
+			if n > stackCount || (n == stackCount && s < stack) {
+				stack, stackCount = s, n
+			}
+		}
+		state, stateCount := "", 0
+		for s, n := range t.states {
+			if n > stateCount || (n == stateCount && s < state) {
+				state, stateCount = s, n
+			}
+		}
+
+		name := t.name
+		if name == "" {
+			name = fmt.Sprintf("Thread-%d", t.javaID)
+		}
+		header := fmt.Sprintf("\"%s\" #%d nid=0x%x cpu=%.2fms elapsed=%.2fs samples=%d",
+			name, t.javaID, t.osID, float64(cpu)/float64(time.Millisecond), end.Sub(start).Seconds(), t.samples)
+		if t.samples > 0 {
+			header += fmt.Sprintf(" hot-stack-samples=%d", stackCount)
+		}
+
+		var lines []string
+		if state != "" {
+			lines = append(lines, "   java.lang.Thread.State: "+state)
+		}
+		if stack != "" {
+			lines = append(lines, strings.TrimSuffix(stack, "\n"))
+		}
+
+		tid := fmt.Sprintf("#%d", t.javaID)
+		res[tid] = &Thread{
+			Header:  header,
+			Name:    name,
+			State:   state,
+			CPU:     cpu,
+			Elapsed: end.Sub(start),
+			JavaID:  tid,
+			TID:     tid,
+			NID:     int(t.osID),
+			Stack:   strings.Join(lines, "\n"),
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures hold the same single-chunk recording, written with and
+// without compressed integers.
+func TestReadJFR(t *testing.T) {
+	for _, path := range []string{"testdata/compressed.jfr", "testdata/uncompressed.jfr"} {
+		t.Run(path, func(t *testing.T) {
+			threads, err := ReadJFR(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(threads) != 2 {
+				t.Fatalf("got %d threads, want 2", len(threads))
+			}
+
+			worker := threads["#11"]
+			if worker == nil {
+				t.Fatal("missing thread #11")
+			}
+			if worker.Name != "worker-1" || worker.JavaID != "#11" || worker.NID != 100 {
+				t.Errorf("got name %q, java ID %q, nid %d", worker.Name, worker.JavaID, worker.NID)
+			}
+			// CPU load is recorded as float32, so allow a little rounding
+			if d := worker.CPU - 10*time.Second; d < -time.Millisecond || d > time.Millisecond || worker.Elapsed != 10*time.Second {
+				t.Errorf("got cpu %v, elapsed %v", worker.CPU, worker.Elapsed)
+			}
+			if worker.State != "RUNNABLE" {
+				t.Errorf("got state %q", worker.State)
+			}
+			if !strings.Contains(worker.Stack, "\tat com.example.Foo.spin(Unknown Source:10)\n") {
+				t.Errorf("unexpected stack:\n%s", worker.Stack)
+			}
+
+			idle := threads["#12"]
+			if idle == nil {
+				t.Fatal("missing thread #12")
+			}
+			if idle.JavaID != "#12" || idle.CPU != 0 || idle.Elapsed != 8*time.Second {
+				t.Errorf("got java ID %q, cpu %v, elapsed %v", idle.JavaID, idle.CPU, idle.Elapsed)
+			}
+		})
+	}
+}
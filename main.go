@@ -15,17 +15,21 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/bits"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/c2nes/jtopthreads/internal/proc"
@@ -33,21 +37,94 @@ import (
 
 // Combined output of jstack with data collected from /proc.
 type StackDump struct {
-	Text      string
+	Text string
+
+	// Process the dump was taken from, if known. ProcStats holds the stats
+	// of the process as a whole under this pid.
+	PID int
+
 	ProcStats map[int]string
 	Uptime    time.Duration
+
+	// utime+stime of each task, which compact /proc samples (see
+	// readCompactProcDump) have in place of the tasks' full stats
+	TaskTicks map[int]uint64
+
+	// Clock ticks per second of the host ProcStats were collected on. Zero if
+	// collected on this host.
+	ClkTck int64
+
+	// Wall clock time the dump was captured at, if known.
+	Time time.Time
+
+	// Time the capture completed, if known. Thread CPU times are read at some
+	// point between Time and End.
+	End time.Time
+
+	// CPU limits of the process's cgroup at the time of the dump, if known.
+	Cgroup *CgroupCPU
+
+	// Thread stats loaded from a companion file. Only used when neither the
+	// thread dump nor /proc provide CPU data.
+	ThreadStats map[int]ThreadStat
+}
+
+// Convert a /proc tick count to a duration.
+func (dump *StackDump) ticks(v uint64) time.Duration {
+	if dump.ClkTck > 0 {
+		return proc.DurationTicks(v, dump.ClkTck)
+	}
+	return proc.Duration(v)
 }
 
 type Thread struct {
 	Header  string
 	Name    string
+	State   string
 	CPU     time.Duration
 	Elapsed time.Duration
+	JavaID  string
 	TID     string
 	NID     int
 	Stack   string
 }
 
+// Identifies a thread across dumps. The tid (the address of the JVM's thread
+// structure) and nid are both reused after a thread exits, so they are
+// combined with the Java thread ID (#N), which is not.
+func (t *Thread) key() string {
+	return fmt.Sprintf("%s/%d/%s", t.JavaID, t.NID, t.TID)
+}
+
+// Extract the Java thread ID (e.g. "#18") which follows the name in the
+// header of Java 8 and later thread dumps.
+func getJavaID(header string, endName int) string {
+	for _, field := range strings.Fields(header[endName+1:]) {
+		if len(field) > 1 && field[0] == '#' && isDigit(field[1]) {
+			return field
+		}
+	}
+	return ""
+}
+
+// Extract the state from the "java.lang.Thread.State: ..." line of a stack,
+// without any detail (e.g. "WAITING (parking)" becomes "WAITING"). Returns an
+// empty string for threads without a state (e.g. VM threads).
+func parseThreadState(lines []string) string {
+	const marker = "java.lang.Thread.State: "
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, marker) {
+			state := strings.TrimPrefix(l, marker)
+			if i := strings.IndexByte(state, ' '); i >= 0 {
+				state = state[:i]
+			}
+			return state
+		}
+	}
+	return ""
+}
+
 func getHeaderField(line string, name string) string {
 	startMarker := name + "="
 	startIdx := strings.Index(line, startMarker)
@@ -113,7 +190,9 @@ func (dump *StackDump) parseThread(lines []string) (*Thread, error) {
 			return nil, err
 		}
 	} else if stat != nil {
-		cpu = proc.Duration(stat.Utime + stat.Stime)
+		cpu = dump.ticks(stat.Utime + stat.Stime)
+	} else if ts, ok := dump.ThreadStats[nid]; ok {
+		cpu = ts.CPU
 	} else {
 		cpu = 0 * time.Second
 	}
@@ -125,7 +204,9 @@ func (dump *StackDump) parseThread(lines []string) (*Thread, error) {
 			return nil, err
 		}
 	} else if stat != nil {
-		elapsed = dump.Uptime - proc.Duration(stat.Starttime)
+		elapsed = dump.Uptime - dump.ticks(stat.Starttime)
+	} else if ts, ok := dump.ThreadStats[nid]; ok {
+		elapsed = ts.Elapsed
 	} else {
 		elapsed = 0 * time.Second
 	}
@@ -133,8 +214,10 @@ func (dump *StackDump) parseThread(lines []string) (*Thread, error) {
 	thread := &Thread{
 		Header:  header,
 		Name:    name,
+		State:   parseThreadState(lines[1:]),
 		CPU:     cpu,
 		Elapsed: elapsed,
+		JavaID:  getJavaID(header, endName),
 		TID:     tid,
 		NID:     nid,
 		Stack:   stack,
@@ -157,7 +240,7 @@ func (dump *StackDump) ParseThreads() (map[string]*Thread, error) {
 				if err != nil {
 					return nil, err
 				}
-				threads[parsed.TID] = parsed
+				threads[parsed.key()] = parsed
 				thread = nil
 			}
 			if len(l) > 0 && l[0] == '"' && strings.Contains(l, "nid=") {
@@ -170,92 +253,335 @@ func (dump *StackDump) ParseThreads() (map[string]*Thread, error) {
 		if err != nil {
 			return nil, err
 		}
-		threads[parsed.TID] = parsed
+		threads[parsed.key()] = parsed
 	}
 	return threads, nil
 }
 
-func printHeader(cpuFrac float64, header string) {
-	fi, err := os.Stdout.Stat()
-	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
-		// Error checking status or non-TTY
-		fmt.Printf("%.6f\t%s\n", cpuFrac, header)
-	} else {
-		fmt.Printf("[%6.2f%%] %s\n", 100*cpuFrac, header)
-	}
+// CPU usage of a single thread over the report window.
+type ThreadCPU struct {
+	Thread  *Thread
+	CPU     time.Duration
+	Elapsed time.Duration
+	Frac    float64
+
+	// Label of the thread's process in multi-process reports
+	Process string
+
+	// The same thread in the first dump, if it was present
+	Prev *Thread
 }
 
-func printTopThreads(dump0, dump1 *StackDump, n int, summary bool) error {
+// Threads ordered by CPU usage between two stack dumps.
+type Report struct {
+	Threads   []*ThreadCPU
+	TotalCPU  time.Duration
+	Elapsed   time.Duration
+	TotalFrac float64
+
+	// Describes why the report is incomplete (e.g. because one of the two
+	// samples failed), or empty if it is complete.
+	Partial string
+
+	// Durations of the two captures, and the resulting uncertainty in the
+	// interval between them, if known.
+	Capture [2]time.Duration
+	Skew    time.Duration
+
+	// CPU available to the process, if known
+	CPULimit *CPULimit
+
+	// The process's CPU usage reconciled against its threads, if known
+	Process *ProcessCPU
+
+	// The reports merged into a multi-process report
+	Processes []*ProcessReport
+
+	// Threads which started or exited between the two dumps. Created threads
+	// are also included in Threads.
+	Created []*ThreadChange
+	Exited  []*ThreadChange
+}
+
+func NewReport(dump0, dump1 *StackDump) (*Report, error) {
 	threads0, err := dump0.ParseThreads()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	threads1, err := dump1.ParseThreads()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	type withCPUFrac struct {
-		frac    float64
-		thread  *Thread
-		cpu     time.Duration
-		elapsed time.Duration
+	report := newThreadsReport(threads0, threads1)
+	for _, t := range report.Threads {
+		if t.Elapsed < 0 {
+			return nil, fmt.Errorf("thread %s ran for %s between the dumps (is the first dump newer than the second?)", threadLabel(t.Thread), t.Elapsed)
+		}
+	}
+	if !dump0.Time.IsZero() && !dump1.Time.IsZero() {
+		report.useCaptureTimes(dump0, dump1)
+	}
+	report.CPULimit = newCPULimit(dump0.Cgroup, dump1.Cgroup)
+	report.Process, err = newProcessCPU(dump0, dump1, report)
+	if err != nil {
+		return nil, err
 	}
+	return report, nil
+}
 
-	var totalCPU time.Duration
-	var maxElapsed time.Duration
-	var top []*withCPUFrac
-	for tid, t1 := range threads1 {
+// Compare threads from two dumps, keyed by Thread.key. Threads only in the
+// second dump are charged all of their CPU, which is exact if the first dump
+// has threads (so they must have started in between) and usage since thread
+// start otherwise.
+func newThreadsReport(threads0, threads1 map[string]*Thread) *Report {
+	report := &Report{}
+	for key, t1 := range threads1 {
 		var cpu time.Duration
 		var elapsed time.Duration
 
-		if t0, ok := threads0[tid]; ok {
+		t0, ok := threads0[key]
+		if ok {
 			cpu = t1.CPU - t0.CPU
 			elapsed = t1.Elapsed - t0.Elapsed
 		} else {
 			cpu = t1.CPU
 			elapsed = t1.Elapsed
+			if len(threads0) > 0 {
+				report.Created = append(report.Created, &ThreadChange{Thread: t1, CPU: cpu})
+			}
 		}
 
-		totalCPU += cpu
-		if elapsed > maxElapsed {
-			maxElapsed = elapsed
+		report.TotalCPU += cpu
+		if elapsed > report.Elapsed {
+			report.Elapsed = elapsed
 		}
 
 		frac := float64(cpu) / float64(elapsed)
-		top = append(top, &withCPUFrac{frac, t1, cpu, elapsed})
+		report.Threads = append(report.Threads, &ThreadCPU{Thread: t1, CPU: cpu, Elapsed: elapsed, Frac: frac, Prev: t0})
 	}
 
-	// Sort by CPU time in descending order
+	report.sortThreads()
+	report.TotalFrac = float64(report.TotalCPU) / float64(report.Elapsed)
+	report.findExited(threads0, threads1)
+	return report
+}
+
+// Sort the threads by CPU fraction in descending order, breaking ties by TID
+// so that output is stable between runs.
+func (r *Report) sortThreads() {
+	top := r.Threads
 	sort.Slice(top, func(i, j int) bool {
-		if top[i].frac == top[j].frac {
-			return top[i].thread.TID < top[j].thread.TID
+		if top[i].Frac == top[j].Frac {
+			return top[i].Thread.TID < top[j].Thread.TID
 		}
-		return top[i].frac > top[j].frac
+		return top[i].Frac > top[j].Frac
 	})
+}
+
+// The n busiest threads, or all threads if n <= 0.
+func (r *Report) Top(n int) []*ThreadCPU {
+	if n <= 0 || n > len(r.Threads) {
+		n = len(r.Threads)
+	}
+	return r.Threads[:n]
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
 
-	if n <= 0 {
-		n = len(top)
+// The width of the terminal f, preferring $COLUMNS if set, or zero if unknown.
+func terminalWidth(f *os.File) int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
 	}
+	return ioctlTerminalWidth(f)
+}
 
-	for _, t := range top[:n] {
-		printHeader(t.frac, t.thread.Header)
+func writeHeader(w io.Writer, tty bool, cpuFrac float64, header string) {
+	if tty {
+		fmt.Fprintf(w, "[%6.2f%%] %s\n", 100*cpuFrac, header)
+	} else {
+		fmt.Fprintf(w, "%.6f\t%s\n", cpuFrac, header)
+	}
+}
 
+// Write the n busiest threads in the report as text. The output is formatted
+// for humans if tty is set, and for other programs otherwise. Each thread's
+// header line is replaced using lines, and stacks are shortened using stacks,
+// if set.
+func writeReport(w io.Writer, report *Report, n int, summary bool, tty bool, lines *lineFormat, stacks *stackOptions) {
+	writeThreads(w, report.Top(n), tty, lines, func(t *ThreadCPU) {
 		if !summary {
-			if len(t.thread.Stack) > 0 {
-				fmt.Println(t.thread.Stack)
+			if len(t.Thread.Stack) > 0 {
+				fmt.Fprintln(w, stacks.apply(t.Thread.Stack))
 			}
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
+	})
+	writeFooter(w, report, n, tty)
+}
+
+// Write the header of each thread (with a process column in multi-process
+// reports), or the line given by lines if set, followed by whatever body
+// writes.
+func writeThreads(w io.Writer, threads []*ThreadCPU, tty bool, lines *lineFormat, body func(t *ThreadCPU)) {
+	if lines != nil {
+		for i, l := range lines.lines(threads, tty) {
+			fmt.Fprintln(w, l)
+			body(threads[i])
+		}
+		return
 	}
 
-	totalFrac := float64(totalCPU) / float64(maxElapsed)
-	printHeader(totalFrac, fmt.Sprintf("Total (elapsed %s)", maxElapsed))
+	width := 0
+	for _, t := range threads {
+		if len(t.Process) > width {
+			width = len(t.Process)
+		}
+	}
+	for _, t := range threads {
+		header := t.Thread.Header
+		if width > 0 {
+			header = fmt.Sprintf("%-*s  %s", width, t.Process, header)
+		}
+		writeHeader(w, tty, t.Frac, header)
+		body(t)
+	}
+}
+
+// Write everything following the threads, ending with the total.
+func writeFooter(w io.Writer, report *Report, n int, tty bool) {
+	// Keep machine-readable output to one "frac<TAB>header" line per entry
+	if tty {
+		writeChurn(w, report, n)
+	} else {
+		writeChurn(os.Stderr, report, n)
+	}
+
+	for _, p := range report.Processes {
+		writeHeader(w, tty, p.Report.TotalFrac, fmt.Sprintf("Total %s (elapsed %s)", p.Label, p.Report.Elapsed.Round(time.Millisecond)))
+	}
+	if report.Process != nil {
+		frac := float64(report.Process.CPU) / float64(report.Elapsed)
+		writeHeader(w, tty, frac, report.Process.format(report.Elapsed))
+	}
+	if report.CPULimit != nil {
+		writeHeader(w, tty, report.TotalFrac/report.CPULimit.CPUs, report.CPULimit.String())
+	}
+
+	elapsed := report.Elapsed.Round(time.Millisecond)
+	total := fmt.Sprintf("Total (elapsed %s)", elapsed)
+	if report.Skew > 0 {
+		total = fmt.Sprintf("Total (elapsed %s, capture %s/%s, skew ±%s)",
+			elapsed, report.Capture[0].Round(time.Microsecond),
+			report.Capture[1].Round(time.Microsecond), report.Skew.Round(time.Microsecond))
+	}
+	if report.Partial != "" {
+		total += " PARTIAL: " + report.Partial
+	}
+	writeHeader(w, tty, report.TotalFrac, total)
+}
+
+type outputOptions struct {
+	format  string
+	n       int
+	summary bool
+	diff    bool
+	dedupe  bool
+
+	// Set by -columns and -template
+	columns  []columnSpec
+	template *template.Template
+
+	stacks stackOptions
+}
+
+var outputFormats = []string{"text", "pprof", "html", "csv", "tsv", "markdown"}
+
+func isOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
 
+// Parse -columns and -template (either of which may be empty) into opts.
+func (opts *outputOptions) setLineFormat(columnList string, tmpl string) error {
+	if columnList != "" && tmpl != "" {
+		return errors.New("-columns and -template cannot be used together")
+	}
+	if columnList != "" {
+		switch opts.format {
+		case "text", "csv", "tsv", "markdown":
+		default:
+			return fmt.Errorf("-columns cannot be used with -format %s", opts.format)
+		}
+		specs, err := parseColumns(columnList)
+		if err != nil {
+			return err
+		}
+		opts.columns = specs
+	}
+	if tmpl != "" {
+		if opts.format != "text" {
+			return fmt.Errorf("-template cannot be used with -format %s", opts.format)
+		}
+		t, err := parseLineTemplate(tmpl)
+		if err != nil {
+			return err
+		}
+		opts.template = t
+	}
 	return nil
 }
 
+func printTopThreads(out *os.File, dump0, dump1 *StackDump, opts *outputOptions) error {
+	report, err := NewReport(dump0, dump1)
+	if err != nil {
+		return err
+	}
+
+	start := dump0.Time
+	if start.IsZero() {
+		start = dump1.Time
+	}
+	return printReport(out, report, start, opts)
+}
+
+func printReport(out *os.File, report *Report, start time.Time, opts *outputOptions) error {
+	switch opts.format {
+	case "pprof":
+		return writePprof(out, report, opts.n, start)
+	case "html":
+		return writeHTML(out, report, opts.n, start, &opts.stacks)
+	case "csv", "tsv", "markdown":
+		return writeTable(out, report, opts.n, opts.format, opts.columns)
+	default:
+		tty := isTerminal(out)
+		var lines *lineFormat
+		if opts.columns != nil || opts.template != nil {
+			lines = &lineFormat{columns: opts.columns, template: opts.template}
+			if tty {
+				lines.width = terminalWidth(out)
+			}
+		}
+		if opts.dedupe {
+			writeDedupedReport(out, report, opts.n, opts.summary, tty, lines, &opts.stacks)
+		} else if opts.diff {
+			writeDiffReport(out, report, opts.n, opts.summary, tty, lines, &opts.stacks)
+		} else {
+			writeReport(out, report, opts.n, opts.summary, tty, lines, &opts.stacks)
+		}
+		return nil
+	}
+}
+
 func parseJavaPID(s string) (int, error) {
 	// Try as pid and then search with JPS
 	pid, err := strconv.Atoi(s)
@@ -345,7 +671,17 @@ func readProcUptime() (time.Duration, error) {
 	return time.Duration(up * float64(time.Second)), nil
 }
 
+// Take a single thread dump, giving up after the default timeout. Callers
+// wanting retries use collectDump.
 func jstack(pid int) (*StackDump, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultCollectOptions.timeout)
+	defer cancel()
+	return jstackContext(ctx, pid)
+}
+
+// Like jstack, but the jstack process is killed if ctx is done first. Any
+// args (e.g. "-l") are passed to jstack.
+func jstackContext(ctx context.Context, pid int, args ...string) (*StackDump, error) {
 	// Read /proc/uptime so we can calculate elapsed process time
 	uptime, err := readProcUptime()
 	if err != nil {
@@ -354,34 +690,124 @@ func jstack(pid int) (*StackDump, error) {
 		}
 	}
 
+	now := time.Now()
+
 	// Collect process stats
 	procResCh := make(chan map[int]string, 1)
 	procErrCh := make(chan error, 1)
+	cgroupCh := make(chan *CgroupCPU, 1)
 	go func() {
 		res, err := collectProcStats(pid)
 		procResCh <- res
 		procErrCh <- err
+		// cgroup limits are informational, so errors are ignored
+		cgroup, _ := readCgroupCPU(pid)
+		cgroupCh <- cgroup
 	}()
 
-	cmd := exec.Command("jstack", strconv.Itoa(pid))
+	cmd := exec.CommandContext(ctx, "jstack", append(args, strconv.Itoa(pid))...)
 	out, err := cmd.CombinedOutput()
 	// Wait for go routine to complete before returning any errors
 	procErr := <-procErrCh
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("jstack: %w", ctx.Err())
+	}
 	if err != nil {
 		return nil, err
 	}
 	if procErr != nil {
 		return nil, procErr
 	}
-	return &StackDump{string(out), <-procResCh, uptime}, nil
+	return &StackDump{
+		Text:      string(out),
+		PID:       pid,
+		ProcStats: <-procResCh,
+		Uptime:    uptime,
+		Time:      now,
+		End:       time.Now(),
+		Cgroup:    <-cgroupCh,
+	}, nil
+}
+
+// A flag which may be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Read a captured thread dump and, optionally, a companion thread stats file.
+func readStackDump(path string, statsPath string) (*StackDump, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &StackDump{Text: string(bytes)}
+	if statsPath != "" {
+		bytes, err := ioutil.ReadFile(statsPath)
+		if err != nil {
+			return nil, err
+		}
+		dump.ThreadStats, err = ParseThreadStats(string(bytes))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", statsPath, err)
+		}
+	}
+
+	return dump, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "capture":
+			captureMain(os.Args[2:])
+			return
+		case "serve":
+			serveMain(os.Args[2:])
+			return
+		case "exporter":
+			exporterMain(os.Args[2:])
+			return
+		case "trigger":
+			triggerMain(os.Args[2:])
+			return
+		case "stuck":
+			stuckMain(os.Args[2:])
+			return
+		case "record":
+			recordMain(os.Args[2:])
+			return
+		case "replay":
+			replayMain(os.Args[2:])
+			return
+		case "blackbox":
+			blackboxMain(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = func() {
 		out := flag.CommandLine.Output()
 		usage := "usage: %s [options] <stack-file> [stack-file]\n"
-		usage += "   or: %s [options] [-sample <duration>] <pid | main-class>\n\n"
-		fmt.Fprintf(out, usage, os.Args[0], os.Args[0])
+		usage += "   or: %s [options] <bundle-file | recording | jfr-file>\n"
+		usage += "   or: %s [options] [-sample <duration>] <pid | main-class>...\n"
+		usage += "   or: %s [options] [-sample <duration>] -all\n"
+		usage += "   or: %s capture [options] <pid | main-class>\n"
+		usage += "   or: %s serve [options] <pid | main-class>...\n"
+		usage += "   or: %s exporter [options] <pid | main-class>...\n"
+		usage += "   or: %s trigger [options] <pid | main-class>\n"
+		usage += "   or: %s stuck [options] <pid | main-class | bundle-file | recording | stack-file...>\n"
+		usage += "   or: %s record [options] <pid | main-class>\n"
+		usage += "   or: %s replay [options] <recording | bundle-file>\n"
+		usage += "   or: %s blackbox [options] <pid | main-class>\n\n"
+		fmt.Fprintf(out, usage, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -392,82 +818,242 @@ func main() {
 		os.Exit(1)
 	}
 
-	topN := 0
+	opts := &outputOptions{format: "text"}
 	duration := time.Duration(0)
-	summary := false
-
-	flag.IntVar(&topN, "n", topN, "limit output to the top `N` threads")
+	output := ""
+	var statsFiles stringsFlag
+	var alerts stringsFlag
+	alertCommand := ""
+	procOnly := false
+	copts := defaultCollectOptions
+	all := false
+	parallel := 4
+	columnList := ""
+	lineTemplate := ""
+
+	flag.IntVar(&opts.n, "n", opts.n, "limit output to the top `N` threads")
 	flag.DurationVar(&duration, "sample", duration, "sample process for `duration`")
-	flag.BoolVar(&summary, "summary", summary, "omit stacks")
+	flag.BoolVar(&opts.summary, "summary", opts.summary, "omit stacks")
+	flag.BoolVar(&opts.diff, "diff", opts.diff, "show how each thread's state and stack changed between the two dumps")
+	flag.BoolVar(&opts.dedupe, "dedupe", opts.dedupe, "show each distinct stack once, with the threads sharing it and their summed CPU")
+	flag.StringVar(&opts.format, "format", opts.format, "output `format` ("+strings.Join(outputFormats, ", ")+")")
+	flag.StringVar(&columnList, "columns", columnList, "show only the given `columns` in place of each thread's header, e.g.\ncpu,state,name:30 where :N truncates to N characters (see README)")
+	flag.StringVar(&lineTemplate, "template", lineTemplate, "format each thread's header line with the Go `template`, e.g.\n'{{.Percent}} {{.State}} {{.Name}}' (see README)")
+	opts.stacks.addFlags(flag.CommandLine)
+	flag.StringVar(&output, "o", output, "write output to `file` instead of stdout")
+	flag.BoolVar(&procOnly, "proc", procOnly, "rank threads using /proc only, joining in a thread dump if jstack\ncompletes within -timeout (Linux only)")
+	flag.DurationVar(&copts.timeout, "timeout", copts.timeout, "give up on each jstack attempt after `duration`")
+	flag.IntVar(&copts.retries, "retries", copts.retries, "retry a failed jstack up to `N` times")
+	flag.Var(&alerts, "alert", "exit with status 3 and print offending stacks if `rule` matches, e.g.\nthread>90%:3, pool=epollEventLoopGroup-*>150% or total>400%:2\n(see README); may be repeated")
+	flag.StringVar(&alertCommand, "alert-command", alertCommand, "run `command` with the alert report on stdin when an alert fires")
+	flag.BoolVar(&all, "all", all, "sample every JVM listed by jps")
+	flag.IntVar(&parallel, "parallel", parallel, "sample at most `N` JVMs at once")
+	flag.Var(&statsFiles, "stats", "read per-thread CPU usage from `file` (output of ps -L, top -H or pidstat -t)\ncaptured alongside each stack file; may be repeated once per stack file")
 	flag.Parse()
 
+	if !isOutputFormat(opts.format) {
+		usageError("unknown format \"%s\"", opts.format)
+	}
+	if err := opts.setLineFormat(columnList, lineTemplate); err != nil {
+		usageError("%v", err)
+	}
+	if opts.dedupe && (opts.diff || opts.format != "text") {
+		usageError("-dedupe can only be used with -format text and without -diff")
+	}
+
+	// Cancel collection (killing any running jstack) on interrupt
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		cancel()
+	}()
+
+	out := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out = f
+	} else if opts.format == "pprof" && isTerminal(out) {
+		usageError("refusing to write pprof profile to a terminal (use -o)")
+	}
+
+	var alertRules []*alertRule
+	for _, a := range alerts {
+		rule, err := parseAlertRule(a)
+		if err != nil {
+			usageError("%v", err)
+		}
+		alertRules = append(alertRules, rule)
+	}
+	alertState := newAlertState(alertRules)
+
 	var dump0, dump1 *StackDump
+	var report *Report
+
+	if len(statsFiles) > 0 && len(statsFiles) != flag.NArg() {
+		usageError("-stats must be given once per stack file")
+	}
+	statsFile := func(i int) string {
+		if i < len(statsFiles) {
+			return statsFiles[i]
+		}
+		return ""
+	}
+
+	// Several pids or main-classes (or -all) are sampled together. Arguments
+	// are only taken as processes if none of them is an existing file, so a
+	// mistyped stack file is reported as missing rather than as a JVM.
+	multi := all
+	if flag.NArg() > 1 {
+		files := 0
+		for _, arg := range flag.Args() {
+			if _, err := os.Stat(arg); err == nil {
+				files++
+			}
+		}
+		if !all && files > 0 && flag.NArg() > 2 {
+			usageError("at most two stack files may be given")
+		}
+		multi = multi || files == 0
+	}
+
+	if multi {
+		if procOnly || len(alertRules) > 0 || len(statsFiles) > 0 {
+			usageError("-proc, -alert and -stats not supported with multiple processes")
+		}
+
+		var jvms []*jvm
+		var err error
+		if all {
+			if flag.NArg() > 0 {
+				usageError("-all does not take arguments")
+			}
+			jvms, err = listJVMs()
+		} else {
+			jvms, err = resolveJVMs(flag.Args())
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if flag.NArg() == 2 {
+		report, err = sampleJVMs(ctx, jvms, duration, copts, parallel)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if flag.NArg() == 2 {
 		if duration > 0 {
 			usageError("-sample not supported with file arguments")
 		}
 
-		bytes0, err := ioutil.ReadFile(flag.Arg(0))
+		var err error
+		dump0, err = readStackDump(flag.Arg(0), statsFile(0))
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		bytes1, err := ioutil.ReadFile(flag.Arg(1))
+		dump1, err = readStackDump(flag.Arg(1), statsFile(1))
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		dump0 = &StackDump{Text: string(bytes0)}
-		dump1 = &StackDump{Text: string(bytes1)}
+		unwrapClock(dump0.ThreadStats, dump1.ThreadStats)
 	} else if flag.NArg() == 1 {
 		arg := flag.Arg(0)
 
 		// A single argument can be a file, pid or main-class. Process as a file
 		// if a matching file exists, otherwise assume the arg is a pid/main-class.
-		if _, err := os.Stat(arg); err == nil {
+		if _, err := os.Stat(arg); err == nil && isJFR(arg) {
 			if duration > 0 {
 				usageError("-sample not supported with file argument")
 			}
+			if len(statsFiles) > 0 {
+				usageError("-stats not supported with JFR recordings")
+			}
 
-			bytes1, err := ioutil.ReadFile(arg)
+			threads, err := ReadJFR(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			report = newThreadsReport(nil, threads)
+		} else if err == nil && (isBundle(arg) || isRecording(arg)) {
+			if duration > 0 {
+				usageError("-sample not supported with file argument")
+			}
+			if len(statsFiles) > 0 {
+				usageError("-stats not supported with bundle argument")
+			}
+
+			// Compare the first and last samples in the bundle or recording
+			dumps, err := readSamples(arg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(dumps) == 0 {
+				log.Fatalf("%s: no samples", arg)
+			}
+
+			report, err = reportSamples(dumps, 0, len(dumps)-1)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(dumps) > 1 {
+				dump0 = dumps[0]
+			}
+		} else if err == nil {
+			if duration > 0 {
+				usageError("-sample not supported with file argument")
+			}
+
+			dump1, err = readStackDump(arg, statsFile(0))
 			if err != nil {
 				log.Fatal(err)
 			}
 
 			dump0 = &StackDump{}
-			dump1 = &StackDump{Text: string(bytes1)}
 		} else {
+			if len(statsFiles) > 0 {
+				usageError("-stats not supported with pid argument")
+			}
+
 			pid, err := parseJavaPID(arg)
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			ch0 := make(chan *StackDump)
-			go func() {
-				dump, err := jstack(pid)
+			if procOnly {
+				report, err = sampleProcOnly(ctx, pid, duration, copts.timeout)
 				if err != nil {
 					log.Fatal(err)
 				}
-				ch0 <- dump
-			}()
-
-			if duration > 0 {
-				ch1 := make(chan *StackDump)
-				go func() {
-					time.Sleep(duration)
-					dump, err := jstack(pid)
+			} else {
+				if len(alertRules) > 0 {
+					if duration <= 0 {
+						usageError("-alert requires -sample with pid argument")
+					}
+					code, err := runAlerts(ctx, out, pid, duration, copts, alertState, opts, alertCommand)
 					if err != nil {
 						log.Fatal(err)
 					}
-					ch1 <- dump
-				}()
+					os.Exit(code)
+				}
 
-				dump0 = <-ch0
-				dump1 = <-ch1
-			} else {
-				dump0 = &StackDump{}
-				dump1 = <-ch0
+				sample, err := sampleProcess(ctx, pid, duration, copts)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if sample.Partial != "" {
+					fmt.Fprintf(os.Stderr, "warning: partial result: %s\n", sample.Partial)
+				}
+				report, err = sample.Report()
+				if err != nil {
+					log.Fatal(err)
+				}
+				dump0 = sample.Dump0
 			}
 		}
 	} else if flag.NArg() < 1 {
@@ -476,7 +1062,41 @@ func main() {
 		usageError("too many arguments")
 	}
 
-	if err := printTopThreads(dump0, dump1, topN, summary); err != nil {
+	var err error
+	if len(alertRules) > 0 {
+		// Only a live process is sampled more than once
+		if alertState.samplesNeeded() > 1 {
+			usageError("-alert with a sample count requires -sample with pid argument")
+		}
+		if report == nil {
+			report, err = NewReport(dump0, dump1)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if fired := alertState.update(report); len(fired) > 0 {
+			if err := reportAlerts(alertOutput(out, opts), report, fired, alertCommand); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(alertExitCode)
+		}
+	}
+
+	if report != nil {
+		start := time.Time{}
+		if dump0 != nil {
+			start = dump0.Time
+		}
+		err = printReport(out, report, start, opts)
+	} else {
+		err = printTopThreads(out, dump0, dump1, opts)
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,212 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A JVM to sample, as listed by jps.
+type jvm struct {
+	pid  int
+	name string
+}
+
+// A short label for the process column, e.g. "1234/Main".
+func (j *jvm) label() string {
+	name := j.name
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	} else if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		return strconv.Itoa(j.pid)
+	}
+	return fmt.Sprintf("%d/%s", j.pid, name)
+}
+
+// List the JVMs running as the current user, excluding jps itself.
+func listJVMs() ([]*jvm, error) {
+	out, err := exec.Command("jps", "-l").Output()
+	if err != nil {
+		return nil, fmt.Errorf("jps: %w", err)
+	}
+
+	var jvms []*jvm
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		pid, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		name := ""
+		if len(parts) == 2 {
+			name = parts[1]
+		}
+		if strings.HasSuffix(name, "sun.tools.jps.Jps") {
+			continue
+		}
+		jvms = append(jvms, &jvm{pid, name})
+	}
+	return jvms, nil
+}
+
+// Resolve pid and main-class arguments, using jps to name the processes.
+// Arguments which cannot be resolved are skipped with a warning; an error is
+// only returned if none can be.
+func resolveJVMs(args []string) ([]*jvm, error) {
+	names := make(map[int]string)
+	if listed, err := listJVMs(); err == nil {
+		for _, j := range listed {
+			names[j.pid] = j.name
+		}
+	}
+
+	var jvms []*jvm
+	for _, arg := range args {
+		pid, err := parseJavaPID(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping %s: %v\n", arg, err)
+			continue
+		}
+		jvms = append(jvms, &jvm{pid, names[pid]})
+	}
+	if len(jvms) == 0 {
+		return nil, fmt.Errorf("no file or JVM found matching %s", strings.Join(args, ", "))
+	}
+	return jvms, nil
+}
+
+// The report for one process of a multi-process report.
+type ProcessReport struct {
+	PID    int
+	Label  string
+	Report *Report
+}
+
+// Sample each JVM concurrently, running at most parallel samples at once, and
+// merge the results into a single report. Processes which cannot be sampled
+// are skipped with a warning; an error is only returned if none can be.
+func sampleJVMs(ctx context.Context, jvms []*jvm, duration time.Duration, copts collectOptions, parallel int) (*Report, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	reports := make([]*Report, len(jvms))
+	errs := make([]error, len(jvms))
+
+	var wg sync.WaitGroup
+	for i, j := range jvms {
+		wg.Add(1)
+		go func(i int, j *jvm) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			sample, err := sampleProcess(ctx, j.pid, duration, copts)
+			if err == nil {
+				reports[i], err = sample.Report()
+			}
+			errs[i] = err
+		}(i, j)
+	}
+	wg.Wait()
+
+	var procs []*ProcessReport
+	var lastErr error
+	for i, j := range jvms {
+		if errs[i] != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping %s: %v\n", j.label(), errs[i])
+			lastErr = errs[i]
+			continue
+		}
+		if reports[i].Partial != "" {
+			fmt.Fprintf(os.Stderr, "warning: partial result for %s: %s\n", j.label(), reports[i].Partial)
+		}
+		procs = append(procs, &ProcessReport{j.pid, j.label(), reports[i]})
+	}
+	if len(procs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no JVMs found")
+		}
+		return nil, lastErr
+	}
+	return mergeReports(procs), nil
+}
+
+// Combine the threads of several processes into a single ranking, labelling
+// each thread with its process. Process CPU is summed if it is known for
+// every process, and the CPU limit is kept if every process is in the same
+// cgroup (with throttling only if every process saw the same).
+func mergeReports(procs []*ProcessReport) *Report {
+	merged := &Report{Processes: procs}
+	if l := procs[0].Report.CPULimit; l != nil {
+		limit := *l
+		merged.CPULimit = &limit
+	}
+	if procs[0].Report.Process != nil {
+		merged.Process = &ProcessCPU{}
+	}
+	for _, p := range procs {
+		for _, t := range p.Report.Threads {
+			labelled := *t
+			labelled.Process = p.Label
+			merged.Threads = append(merged.Threads, &labelled)
+		}
+		merged.TotalCPU += p.Report.TotalCPU
+		if p.Report.Elapsed > merged.Elapsed {
+			merged.Elapsed = p.Report.Elapsed
+		}
+		if p.Report.Partial != "" {
+			merged.Partial = "some processes have partial results"
+		}
+		merged.Created = append(merged.Created, p.Report.Created...)
+		merged.Exited = append(merged.Exited, p.Report.Exited...)
+
+		if pc := p.Report.Process; pc != nil && merged.Process != nil {
+			merged.Process.CPU += pc.CPU
+			merged.Process.Threads += pc.Threads
+			merged.Process.Native += pc.Native
+			merged.Process.NativeCount += pc.NativeCount
+			merged.Process.Unaccounted += pc.Unaccounted
+			merged.Process.Children += pc.Children
+		} else {
+			merged.Process = nil
+		}
+		if l := p.Report.CPULimit; l == nil || merged.CPULimit == nil ||
+			l.Path != merged.CPULimit.Path || l.CPUs != merged.CPULimit.CPUs || l.Source != merged.CPULimit.Source {
+			merged.CPULimit = nil
+		} else if *l != *merged.CPULimit {
+			merged.CPULimit.Periods, merged.CPULimit.Throttled, merged.CPULimit.ThrottledTime = 0, 0, 0
+		}
+	}
+	merged.sortChurn()
+
+	top := merged.Threads
+	sort.SliceStable(top, func(i, j int) bool {
+		return top[i].Frac > top[j].Frac
+	})
+	merged.TotalFrac = float64(merged.TotalCPU) / float64(merged.Elapsed)
+	return merged
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Rewrites of names which the JVM or code generation libraries make unique
+// per class instance or object, and so differ between dumps and runs of the
+// same code. Applied in order.
+var normalizations = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Lambdas, e.g. Foo$$Lambda$70/0x00000008001c4040 (Java 9+),
+	// Foo$$Lambda$70/1234567 (Java 8) and Foo$$Lambda/0x000000080013c000
+	// (Java 21+)
+	{regexp.MustCompile(`\$\$Lambda(\$\d+)?(/(0x[0-9a-fA-F]+|\d+))?`), "$$$$Lambda"},
+	// Other hidden classes, e.g. LambdaForm$MH/0x0000000800c0e000
+	{regexp.MustCompile(`/0x[0-9a-fA-F]+`), ""},
+	// CGLIB proxies, e.g. Foo$$EnhancerBySpringCGLIB$$abc123 and
+	// Foo$$FastClassByCGLIB$$abc123
+	{regexp.MustCompile(`\$\$(\w+?By\w*CGLIB)\$\$[0-9a-fA-F]+`), "$$$$$1"},
+	// ByteBuddy, Mockito and Hibernate proxies, e.g. Foo$ByteBuddy$abc123
+	{regexp.MustCompile(`\$(ByteBuddy|MockitoMock|HibernateProxy)\$\w+`), "$$$1"},
+	// Reflection accessors, e.g. jdk.internal.reflect.GeneratedMethodAccessor123
+	{regexp.MustCompile(`(Generated\w*Accessor)\d+`), "$1"},
+	// Dynamic proxies, e.g. jdk.proxy2/jdk.proxy2.$Proxy45
+	{regexp.MustCompile(`\$Proxy\d+`), "$$Proxy"},
+	{regexp.MustCompile(`\bjdk\.proxy\d+\b`), "jdk.proxy"},
+	// Object addresses in lock lines, e.g. - locked <0x0000000683652818>
+	{regexp.MustCompile(`<0x[0-9a-fA-F]+>`), "<address>"},
+}
+
+// Normalize synthetic names in a frame or stack line, so the same code path
+// compares equal across dumps and JVM restarts, e.g.
+//
+//	RequestHandler$$Lambda$70/0x00000008001c4040.apply  ->  RequestHandler$$Lambda.apply
+//	GeneratedMethodAccessor123.invoke                    ->  GeneratedMethodAccessor.invoke
+//	- locked <0x0000000683652818>                        ->  - locked <address>
+func normalizeName(s string) string {
+	// Cheap check for the common case of nothing to rewrite
+	if !strings.ContainsAny(s, "$/<") && !strings.Contains(s, "Generated") && !strings.Contains(s, "jdk.proxy") {
+		return s
+	}
+	for _, n := range normalizations {
+		s = n.re.ReplaceAllString(s, n.repl)
+	}
+	return s
+}
+
+// Normalize each line of a stack (see normalizeName).
+func normalizeStack(stack string) string {
+	lines := strings.Split(stack, "\n")
+	for i, l := range lines {
+		lines[i] = normalizeName(l)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Normalize a thread name to the name of the pool it belongs to by stripping
+// the trailing thread number, e.g.
+//
+//	epollEventLoopGroup-5-3  ->  epollEventLoopGroup-5
+//	GC Thread#3              ->  GC Thread
+//	pool-1-thread-7          ->  pool-1-thread
+//
+// Names consisting only of digits are normalized to "other".
+func poolName(name string) string {
+	end := len(name)
+	for end > 0 && isDigit(name[end-1]) {
+		end--
+	}
+	if end == len(name) {
+		return name
+	}
+	if end > 0 && strings.IndexByte("-#_ .", name[end-1]) >= 0 {
+		end--
+	}
+	if end == 0 {
+		return "other"
+	}
+	return name[:end]
+}
+
+// Bounds the number of distinct pool names, mapping any pools beyond the limit
+// to "other".
+type poolLimiter struct {
+	max   int
+	pools map[string]bool
+}
+
+func newPoolLimiter(max int) *poolLimiter {
+	return &poolLimiter{max, make(map[string]bool)}
+}
+
+func (l *poolLimiter) pool(threadName string) string {
+	pool := poolName(threadName)
+	if l.pools[pool] {
+		return pool
+	}
+	if len(l.pools) >= l.max {
+		return "other"
+	}
+	l.pools[pool] = true
+	return pool
+}
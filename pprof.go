@@ -0,0 +1,203 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Minimal protocol buffer encoder, sufficient for writing profile.proto
+// messages (see https://github.com/google/pprof/blob/master/proto/profile.proto).
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+	b.data = append(b.data, byte(v))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64(field int, v uint64) {
+	if v != 0 {
+		b.key(field, 0)
+		b.varint(v)
+	}
+}
+
+func (b *protoBuffer) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(v)))
+	b.data = append(b.data, v...)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.bytes(field, m.data)
+}
+
+func (b *protoBuffer) packedUint64s(field int, vs []uint64) {
+	if len(vs) > 0 {
+		var p protoBuffer
+		for _, v := range vs {
+			p.varint(v)
+		}
+		b.bytes(field, p.data)
+	}
+}
+
+// Builds a profile.proto message. Functions and locations are deduplicated
+// by Java method and source line.
+type pprofBuilder struct {
+	profile   protoBuffer
+	strings   map[string]int64
+	functions map[string]uint64
+	locations map[Frame]uint64
+}
+
+func newPprofBuilder() *pprofBuilder {
+	b := &pprofBuilder{
+		strings:   make(map[string]int64),
+		functions: make(map[string]uint64),
+		locations: make(map[Frame]uint64),
+	}
+	// The string table must start with the empty string
+	b.str("")
+	return b
+}
+
+func (b *pprofBuilder) str(s string) int64 {
+	if id, ok := b.strings[s]; ok {
+		return id
+	}
+	id := int64(len(b.strings))
+	b.strings[s] = id
+	b.profile.bytes(6, []byte(s))
+	return id
+}
+
+func (b *pprofBuilder) valueType(field int, typ, unit string) {
+	var m protoBuffer
+	m.int64(1, b.str(typ))
+	m.int64(2, b.str(unit))
+	b.profile.message(field, &m)
+}
+
+func (b *pprofBuilder) function(frame Frame) uint64 {
+	key := frame.Method + "\x00" + frame.File
+	if id, ok := b.functions[key]; ok {
+		return id
+	}
+	id := uint64(len(b.functions) + 1)
+	b.functions[key] = id
+
+	var m protoBuffer
+	m.uint64(1, id)
+	m.int64(2, b.str(frame.Method))
+	m.int64(3, b.str(frame.Method))
+	m.int64(4, b.str(frame.File))
+	b.profile.message(5, &m)
+	return id
+}
+
+func (b *pprofBuilder) location(frame Frame) uint64 {
+	if id, ok := b.locations[frame]; ok {
+		return id
+	}
+	id := uint64(len(b.locations) + 1)
+	b.locations[frame] = id
+
+	var line protoBuffer
+	line.uint64(1, b.function(frame))
+	line.int64(2, int64(frame.Line))
+
+	var m protoBuffer
+	m.uint64(1, id)
+	m.message(4, &line)
+	b.profile.message(4, &m)
+	return id
+}
+
+func (b *pprofBuilder) sample(frames []Frame, value int64, labels []string) {
+	var m protoBuffer
+	locs := make([]uint64, len(frames))
+	for i, frame := range frames {
+		locs[i] = b.location(frame)
+	}
+	m.packedUint64s(1, locs)
+	m.packedUint64s(2, []uint64{uint64(value)})
+	for i := 0; i < len(labels); i += 2 {
+		var label protoBuffer
+		label.int64(1, b.str(labels[i]))
+		label.int64(2, b.str(labels[i+1]))
+		m.message(3, &label)
+	}
+	b.profile.message(2, &m)
+}
+
+// Write the n busiest threads in the report as a gzipped pprof profile. Each
+// thread is a sample weighted by the CPU time it used in the report window.
+// Threads without a Java stack (e.g. GC threads) are given a single frame
+// named after the thread so their CPU usage is still represented. Synthetic
+// class names are normalized so that, e.g., lambdas aggregate across runs.
+func writePprof(w io.Writer, report *Report, n int, start time.Time) error {
+	b := newPprofBuilder()
+	b.valueType(1, "cpu", "nanoseconds")
+
+	for _, t := range report.Top(n) {
+		if t.CPU <= 0 {
+			continue
+		}
+		frames := t.Thread.Frames()
+		for i := range frames {
+			frames[i].Method = normalizeName(frames[i].Method)
+		}
+		if len(frames) == 0 {
+			frames = []Frame{{Method: fmt.Sprintf("[%s]", t.Thread.Name)}}
+		}
+		labels := []string{"thread", t.Thread.Name}
+		if t.Process != "" {
+			labels = append(labels, "process", t.Process)
+		}
+		if t.Thread.State != "" {
+			labels = append(labels, "state", t.Thread.State)
+		}
+		b.sample(frames, int64(t.CPU), labels)
+	}
+
+	if !start.IsZero() {
+		b.profile.int64(9, start.UnixNano())
+	}
+	b.profile.int64(10, int64(report.Elapsed))
+	b.valueType(11, "cpu", "nanoseconds")
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b.profile.data); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+// Collect /proc data for the process without taking a thread dump.
+func readProcDump(pid int) (*StackDump, error) {
+	uptime, err := readProcUptime()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stats, err := collectProcStats(pid)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, fmt.Errorf("process %d not found", pid)
+	}
+	end := time.Now()
+	cgroup, _ := readCgroupCPU(pid)
+	return &StackDump{PID: pid, ProcStats: stats, Uptime: uptime, Time: now, End: end, Cgroup: cgroup}, nil
+}
+
+// Read a compact /proc sample, with the stats of the process as a whole but
+// only the CPU ticks of each task, which is cheap enough to record every
+// second.
+func readCompactProcDump(pid int) (*StackDump, error) {
+	uptime, err := readProcUptime()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stats, err := collectProcStats(pid)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, fmt.Errorf("process %d not found", pid)
+	}
+	end := time.Now()
+
+	ticks := make(map[int]uint64)
+	for tid, line := range stats {
+		if tid == pid {
+			continue
+		}
+		stat, err := proc.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		ticks[tid] = stat.Utime + stat.Stime
+	}
+	procStats := map[int]string{pid: stats[pid]}
+	return &StackDump{PID: pid, ProcStats: procStats, TaskTicks: ticks, Uptime: uptime, Time: now, End: end}, nil
+}
+
+// Threads built from /proc data alone, keyed by native thread ID and start
+// time (as thread IDs are reused). Names are the kernel's thread names, which
+// the JVM truncates to 15 characters. Compact samples have neither names nor
+// start times, so when comparing with one (byTID) threads are keyed by native
+// thread ID alone and their elapsed time is unknown.
+func (dump *StackDump) procThreads(byTID bool) (map[string]*Thread, error) {
+	threads := make(map[string]*Thread)
+	for tid, line := range dump.ProcStats {
+		stat, err := proc.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing /proc/[pid]/task/[tid]/stat: %w", err)
+		}
+		key := fmt.Sprintf("%d/%d", tid, stat.Starttime)
+		elapsed := dump.Uptime - dump.ticks(stat.Starttime)
+		if byTID {
+			key, elapsed = strconv.Itoa(tid), 0
+		}
+		threads[key] = &Thread{
+			Header:  fmt.Sprintf("\"%s\" nid=0x%x state=%c (from /proc)", stat.Comm, tid, stat.State),
+			Name:    stat.Comm,
+			CPU:     dump.ticks(stat.Utime + stat.Stime),
+			Elapsed: elapsed,
+			TID:     strconv.Itoa(tid),
+			NID:     tid,
+		}
+	}
+	for tid, ticks := range dump.TaskTicks {
+		threads[strconv.Itoa(tid)] = &Thread{
+			Header: fmt.Sprintf("nid=0x%x (from /proc)", tid),
+			CPU:    dump.ticks(ticks),
+			TID:    strconv.Itoa(tid),
+			NID:    tid,
+		}
+	}
+	return threads, nil
+}
+
+// Replace /proc derived thread details with those from a thread dump, where
+// the dump has a thread with the same nid. Created and exited threads are
+// joined too, so the churn summary shows their Java names.
+func joinThreadDump(report *Report, dump *StackDump) error {
+	threads, err := dump.ParseThreads()
+	if err != nil {
+		return err
+	}
+	byNID := make(map[int]*Thread)
+	for _, t := range threads {
+		byNID[t.NID] = t
+	}
+	joined := make(map[*Thread]*Thread)
+	join := func(t *Thread) *Thread {
+		if j, ok := joined[t]; ok {
+			return j
+		}
+		j := t
+		if dt, ok := byNID[t.NID]; ok {
+			j = &Thread{}
+			*j = *dt
+			j.CPU = t.CPU
+			j.Elapsed = t.Elapsed
+		}
+		joined[t] = j
+		return j
+	}
+	for _, t := range report.Threads {
+		t.Thread = join(t.Thread)
+	}
+	for _, c := range append(report.Created, report.Exited...) {
+		c.Thread = join(c.Thread)
+		if c.Reuses != nil {
+			c.Reuses = join(c.Reuses)
+		}
+	}
+	report.sortChurn()
+	return nil
+}
+
+// Compare the /proc stats of two dumps, ignoring any thread dump text.
+func newProcReport(dump0, dump1 *StackDump) (*Report, error) {
+	byTID := len(dump0.TaskTicks) > 0 || len(dump1.TaskTicks) > 0
+	threads0, err := dump0.procThreads(byTID)
+	if err != nil {
+		return nil, err
+	}
+	threads1, err := dump1.procThreads(byTID)
+	if err != nil {
+		return nil, err
+	}
+	// The entry for the pid itself is the process as a whole
+	for _, threads := range []map[string]*Thread{threads0, threads1} {
+		for key, t := range threads {
+			if t.NID == dump1.PID {
+				delete(threads, key)
+			}
+		}
+	}
+	report := newThreadsReport(threads0, threads1)
+	if !dump0.Time.IsZero() && !dump1.Time.IsZero() {
+		report.useCaptureTimes(dump0, dump1)
+	}
+	report.CPULimit = newCPULimit(dump0.Cgroup, dump1.Cgroup)
+	report.Process, err = newProcessCPU(dump0, dump1, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Rank threads using only /proc, so we get results even if jstack hangs or
+// fails (e.g. because the JVM is wedged). A thread dump is attempted in the
+// background and joined in if it completes within the timeout.
+func sampleProcOnly(ctx context.Context, pid int, duration time.Duration, timeout time.Duration) (*Report, error) {
+	dumpCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		dump *StackDump
+		err  error
+	}
+	dumpCh := make(chan result, 1)
+	go func() {
+		dump, err := jstackContext(dumpCtx, pid)
+		dumpCh <- result{dump, err}
+	}()
+
+	dump0 := &StackDump{}
+	if duration > 0 {
+		var err error
+		dump0, err = readProcDump(pid)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	dump1, err := readProcDump(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := newProcReport(dump0, dump1)
+	if err != nil {
+		return nil, err
+	}
+
+	res := <-dumpCh
+	if res.err != nil {
+		fmt.Fprintf(os.Stderr, "warning: thread dump unavailable (%v), showing /proc data only\n", res.err)
+		return report, nil
+	}
+	if err := joinThreadDump(report, res.dump); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: unable to parse thread dump (%v), showing /proc data only\n", err)
+	}
+	return report, nil
+}
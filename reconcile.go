@@ -0,0 +1,133 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+// Process-wide CPU usage over a report window, broken down by where it went.
+// The kernel charges the CPU of exited threads to the process, so anything
+// not accounted for by live threads was used by threads which exited during
+// the window (or, for reports since process start, at any time).
+type ProcessCPU struct {
+	// utime+stime of the process as a whole
+	CPU time.Duration
+	// CPU of the threads in the report
+	Threads time.Duration
+	// CPU of live threads missing from the report, e.g. native threads
+	// which are not attached to the JVM and so do not appear in thread dumps
+	Native      time.Duration
+	NativeCount int
+	// CPU of threads which exited, plus any rounding differences
+	Unaccounted time.Duration
+	// cutime+cstime of child processes which were waited for
+	Children time.Duration
+}
+
+// Reconcile the threads in the report against the CPU usage of the process
+// as a whole. Returns nil if the dumps do not include the process's stats.
+func newProcessCPU(dump0, dump1 *StackDump, report *Report) (*ProcessCPU, error) {
+	pid := dump1.PID
+	line1, ok := dump1.ProcStats[pid]
+	if pid == 0 || !ok {
+		return nil, nil
+	}
+	p1, err := proc.Parse(line1)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing /proc/[pid]/stat: %w", err)
+	}
+	p0 := &proc.ProcStat{Starttime: p1.Starttime}
+	if line0, ok := dump0.ProcStats[pid]; ok && dump0.PID == pid {
+		if p0, err = proc.Parse(line0); err != nil {
+			return nil, fmt.Errorf("error parsing /proc/[pid]/stat: %w", err)
+		}
+	}
+	// A different process which reused the pid
+	if p0.Starttime != p1.Starttime {
+		return nil, nil
+	}
+
+	nids := make(map[int]bool)
+	for _, t := range report.Threads {
+		nids[t.Thread.NID] = true
+	}
+
+	usage := &ProcessCPU{Threads: report.TotalCPU}
+	for tid, line := range dump1.ProcStats {
+		if tid == pid || nids[tid] {
+			continue
+		}
+		t1, err := proc.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing /proc/[pid]/task/[tid]/stat: %w", err)
+		}
+		ticks := t1.Utime + t1.Stime
+		if line0, ok := dump0.ProcStats[tid]; ok {
+			t0, err := proc.Parse(line0)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing /proc/[pid]/task/[tid]/stat: %w", err)
+			}
+			if t0.Starttime == t1.Starttime && t0.Utime+t0.Stime <= ticks {
+				ticks -= t0.Utime + t0.Stime
+			}
+		} else if t0, ok := dump0.TaskTicks[tid]; ok && t0 <= ticks {
+			ticks -= t0
+		}
+		usage.Native += dump1.ticks(ticks)
+		usage.NativeCount++
+	}
+	for tid, ticks := range dump1.TaskTicks {
+		if nids[tid] {
+			continue
+		}
+		if t0, ok := dump0.TaskTicks[tid]; ok && t0 <= ticks {
+			ticks -= t0
+		} else if line0, ok := dump0.ProcStats[tid]; ok {
+			t0, err := proc.Parse(line0)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing /proc/[pid]/task/[tid]/stat: %w", err)
+			}
+			if t0.Utime+t0.Stime <= ticks {
+				ticks -= t0.Utime + t0.Stime
+			}
+		}
+		usage.Native += dump1.ticks(ticks)
+		usage.NativeCount++
+	}
+
+	if cpu0, cpu1 := p0.Utime+p0.Stime, p1.Utime+p1.Stime; cpu1 >= cpu0 {
+		usage.CPU = dump1.ticks(cpu1 - cpu0)
+	}
+	if c0, c1 := p0.Cutime+p0.Cstime, p1.Cutime+p1.Cstime; c1 >= c0 && c0 >= 0 {
+		usage.Children = dump1.ticks(uint64(c1 - c0))
+	}
+	if rest := usage.CPU - usage.Threads - usage.Native; rest > 0 {
+		usage.Unaccounted = rest
+	}
+	return usage, nil
+}
+
+// Describes the process's usage, with each part as a percentage of elapsed.
+func (p *ProcessCPU) format(elapsed time.Duration) string {
+	pct := func(d time.Duration) string {
+		return fmt.Sprintf("%.2f%%", 100*float64(d)/float64(elapsed))
+	}
+	return fmt.Sprintf("Process (threads %s, %d other threads %s, exited or unaccounted %s, child processes %s)",
+		pct(p.Threads), p.NativeCount, pct(p.Native), pct(p.Unaccounted), pct(p.Children))
+}
@@ -0,0 +1,457 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+// A single sample in a recording. Recordings are append-only files with one
+// JSON encoded sample per line, so a recording cut short (e.g. by a crash)
+// loses at most its final sample. Samples without text have only /proc stats.
+type recordEntry struct {
+	Time      time.Time      `json:"time"`
+	End       time.Time      `json:"end"`
+	PID       int            `json:"pid"`
+	Uptime    time.Duration  `json:"uptime"`
+	ClkTck    int64          `json:"clk_tck"`
+	Cgroup    *CgroupCPU     `json:"cgroup,omitempty"`
+	Text      string         `json:"text"`
+	ProcStats map[int]string `json:"proc_stats,omitempty"`
+	TaskTicks map[int]uint64 `json:"task_ticks,omitempty"`
+}
+
+type Recorder struct {
+	f *os.File
+}
+
+// Open a recording for appending, creating it if necessary. A partial final
+// line (e.g. left by a crash) is truncated so that new samples start on a
+// line of their own.
+func OpenRecording(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := truncatePartialLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Recorder{f}, nil
+}
+
+// Truncate f after its last newline, if it does not end with one.
+func truncatePartialLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			if start+int64(i)+1 == size {
+				return nil
+			}
+			return f.Truncate(start + int64(i) + 1)
+		}
+		end = start
+	}
+	if size == 0 {
+		return nil
+	}
+	return f.Truncate(0)
+}
+
+func (r *Recorder) Add(dump *StackDump) error {
+	line, err := json.Marshal(&recordEntry{
+		Time:      dump.Time,
+		End:       dump.End,
+		PID:       dump.PID,
+		Uptime:    dump.Uptime,
+		ClkTck:    proc.ClockTicks(),
+		Cgroup:    dump.Cgroup,
+		Text:      dump.Text,
+		ProcStats: dump.ProcStats,
+		TaskTicks: dump.TaskTicks,
+	})
+	if err != nil {
+		return err
+	}
+	// Write each sample with a single call so concurrent readers never see
+	// part of a line followed by another sample.
+	_, err = r.f.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	return r.f.Close()
+}
+
+func isRecording(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	var entry recordEntry
+	return json.Unmarshal(line, &entry) == nil && !entry.Time.IsZero()
+}
+
+// Read all samples in a recording. A truncated final line is ignored.
+func ReadRecording(path string) ([]*StackDump, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var dumps []*StackDump
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Samples may be written out of order, e.g. when a thread dump
+			// completes after /proc samples taken while it was running
+			sort.SliceStable(dumps, func(i, j int) bool {
+				return dumps[i].Time.Before(dumps[j].Time)
+			})
+			return dumps, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry recordEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		dumps = append(dumps, &StackDump{
+			Text:      entry.Text,
+			PID:       entry.PID,
+			ProcStats: entry.ProcStats,
+			TaskTicks: entry.TaskTicks,
+			Uptime:    entry.Uptime,
+			ClkTck:    entry.ClkTck,
+			Time:      entry.Time,
+			End:       entry.End,
+			Cgroup:    entry.Cgroup,
+		})
+	}
+}
+
+// Report on the CPU window between samples i and j of a recording (or on
+// sample j alone if they are the same). If either sample has only /proc stats,
+// threads are ranked by those and the nearest thread dump is joined in.
+func reportSamples(dumps []*StackDump, i, j int) (*Report, error) {
+	dump0 := &StackDump{}
+	if i != j {
+		dump0 = dumps[i]
+	}
+	dump1 := dumps[j]
+	if dump1.Text != "" && (i == j || dump0.Text != "") {
+		return NewReport(dump0, dump1)
+	}
+
+	report, err := newProcReport(dump0, dump1)
+	if err != nil {
+		return nil, err
+	}
+	for d := 0; d < len(dumps); d++ {
+		for _, k := range []int{j - d, j + d} {
+			if k >= 0 && k < len(dumps) && dumps[k].Text != "" {
+				return report, joinThreadDump(report, dumps[k])
+			}
+		}
+	}
+	return report, nil
+}
+
+// Read the samples from a bundle or recording.
+func readSamples(path string) ([]*StackDump, error) {
+	if isBundle(path) {
+		dumps, _, err := ReadBundle(path)
+		return dumps, err
+	}
+	return ReadRecording(path)
+}
+
+// Implements "jtopthreads record", which appends samples of a live process to
+// a recording until interrupted.
+func recordMain(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s record [options] <pid | main-class>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	output := ""
+	count := 0
+	interval := 5 * time.Second
+
+	fs.StringVar(&output, "o", output, "append samples to `file` (default jtopthreads-<pid>-<time>.rec)")
+	fs.IntVar(&count, "count", count, "stop after `N` samples (0 to record until interrupted)")
+	fs.DurationVar(&interval, "interval", interval, "wait `duration` between samples")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || count < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	pid, err := parseJavaPID(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if output == "" {
+		output = fmt.Sprintf("jtopthreads-%d-%s.rec", pid, time.Now().Format("20060102T150405"))
+	}
+
+	r, err := OpenRecording(output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Stop cleanly on interrupt, discarding any sample in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		signal.Stop(interrupt)
+		cancel()
+	}()
+
+	n := 0
+	for count == 0 || n < count {
+		if n > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		dump, err := collectDump(ctx, pid, defaultCollectOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Fatal(err)
+		}
+		if err := r.Add(dump); err != nil {
+			log.Fatal(err)
+		}
+		n++
+	}
+
+	if err := r.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d samples to %s\n", n, output)
+}
+
+// Resolve a sample index, counting from the end if negative.
+func sampleIndex(i, n int) (int, error) {
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("sample %d out of range (recording has %d samples)", i, n)
+	}
+	return i, nil
+}
+
+// Implements "jtopthreads replay", which produces reports from a recording (or
+// bundle) as if it were being sampled live.
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s replay [options] <recording | bundle-file>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	opts := &outputOptions{format: "text"}
+	start, end := 0, -1
+	step := false
+	list := false
+	output := ""
+	var alerts stringsFlag
+	alertCommand := ""
+	columnList := ""
+	lineTemplate := ""
+
+	fs.IntVar(&start, "start", start, "begin the CPU window at sample `N` (negative counts from the end)")
+	fs.IntVar(&end, "end", end, "end the CPU window at sample `N` (negative counts from the end)")
+	fs.BoolVar(&step, "step", step, "report each pair of consecutive samples between -start and -end in turn")
+	fs.BoolVar(&list, "list", list, "list the samples in the recording")
+	fs.IntVar(&opts.n, "n", opts.n, "limit output to the top `N` threads")
+	fs.BoolVar(&opts.summary, "summary", opts.summary, "omit stacks")
+	fs.BoolVar(&opts.diff, "diff", opts.diff, "show how each thread's state and stack changed between samples")
+	fs.BoolVar(&opts.dedupe, "dedupe", opts.dedupe, "show each distinct stack once, with the threads sharing it and their summed CPU")
+	fs.StringVar(&opts.format, "format", opts.format, "output `format` ("+strings.Join(outputFormats, ", ")+")")
+	fs.StringVar(&columnList, "columns", columnList, "show only the given `columns` in place of each thread's header (see the main -columns option)")
+	fs.StringVar(&lineTemplate, "template", lineTemplate, "format each thread's header line with the Go `template` (see the main -template option)")
+	opts.stacks.addFlags(fs)
+	fs.StringVar(&output, "o", output, "write output to `file` instead of stdout")
+	fs.Var(&alerts, "alert", "evaluate alert `rule` against each step (see the main -alert option)")
+	fs.StringVar(&alertCommand, "alert-command", alertCommand, "run `command` with the alert report on stdin when an alert fires")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if !isOutputFormat(opts.format) {
+		log.Fatalf("unknown format \"%s\"", opts.format)
+	}
+	// Other formats are whole documents, which can't be concatenated
+	if step && opts.format != "text" {
+		log.Fatal("-step can only be used with -format text")
+	}
+	if err := opts.setLineFormat(columnList, lineTemplate); err != nil {
+		log.Fatal(err)
+	}
+	if opts.dedupe && (opts.diff || opts.format != "text") {
+		log.Fatal("-dedupe can only be used with -format text and without -diff")
+	}
+
+	dumps, err := readSamples(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(dumps) == 0 {
+		log.Fatalf("%s: no samples", fs.Arg(0))
+	}
+
+	if list {
+		for i, dump := range dumps {
+			if dump.Text == "" {
+				fmt.Printf("%d\t%s\t%d tasks (/proc only)\n", i, dump.Time.Format(time.RFC3339Nano), len(dump.ProcStats)-1+len(dump.TaskTicks))
+				continue
+			}
+			threads, err := dump.ParseThreads()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%d\t%s\t%d threads\n", i, dump.Time.Format(time.RFC3339Nano), len(threads))
+		}
+		return
+	}
+
+	if start, err = sampleIndex(start, len(dumps)); err != nil {
+		log.Fatal(err)
+	}
+	if end, err = sampleIndex(end, len(dumps)); err != nil {
+		log.Fatal(err)
+	}
+	if end < start {
+		log.Fatal("-end must not be before -start")
+	}
+
+	var alertRules []*alertRule
+	for _, a := range alerts {
+		rule, err := parseAlertRule(a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertRules = append(alertRules, rule)
+	}
+	alertState := newAlertState(alertRules)
+
+	out := os.Stdout
+	if output != "" {
+		if out, err = os.Create(output); err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+
+	// Pairs of samples to report on
+	type window struct{ i, j int }
+	var windows []window
+	if step && end > start {
+		for i := start; i < end; i++ {
+			windows = append(windows, window{i, i + 1})
+		}
+	} else {
+		windows = append(windows, window{start, end})
+	}
+
+	for k, w := range windows {
+		report, err := reportSamples(dumps, w.i, w.j)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dump1 := dumps[w.j]
+
+		if len(alertRules) > 0 {
+			if fired := alertState.update(report); len(fired) > 0 {
+				if err := reportAlerts(alertOutput(out, opts), report, fired, alertCommand); err != nil {
+					log.Fatal(err)
+				}
+				out.Close()
+				os.Exit(alertExitCode)
+			}
+			// As when sampling a live process, only the last report is shown
+			// if no alert fires
+			if k < len(windows)-1 {
+				continue
+			}
+			windows = windows[k:]
+		}
+		if len(windows) > 1 {
+			fmt.Fprintf(out, "Samples %d-%d (%s)\n\n", w.i, w.j, dump1.Time.Format(time.RFC3339))
+		}
+		if err := printReport(out, report, dumps[w.i].Time, opts); err != nil {
+			log.Fatal(err)
+		}
+		if len(windows) > 1 {
+			fmt.Fprintln(out)
+		}
+	}
+}
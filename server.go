@@ -0,0 +1,481 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jsonThread struct {
+	Name     string  `json:"name"`
+	TID      string  `json:"tid"`
+	NID      int     `json:"nid"`
+	Header   string  `json:"header"`
+	CPU      float64 `json:"cpu_seconds"`
+	Elapsed  float64 `json:"elapsed_seconds"`
+	Fraction float64 `json:"fraction"`
+	Stack    string  `json:"stack,omitempty"`
+}
+
+type jsonReport struct {
+	Target   string       `json:"target"`
+	PID      int          `json:"pid"`
+	Time     time.Time    `json:"time"`
+	Threads  []jsonThread `json:"threads"`
+	TotalCPU float64      `json:"total_cpu_seconds"`
+	Elapsed  float64      `json:"elapsed_seconds"`
+	Fraction float64      `json:"fraction"`
+	Partial  string       `json:"partial,omitempty"`
+	Capture  []float64    `json:"capture_seconds,omitempty"`
+	Skew     float64      `json:"skew_seconds,omitempty"`
+	CPULimit *jsonLimit   `json:"cpu_limit,omitempty"`
+	Process  *jsonProcess `json:"process,omitempty"`
+	Created  []jsonChange `json:"created,omitempty"`
+	Exited   []jsonChange `json:"exited,omitempty"`
+	Churn    []*jsonChurn `json:"churn,omitempty"`
+}
+
+// A thread created or exited between the two samples of a report.
+type jsonChange struct {
+	Name   string  `json:"name"`
+	JavaID string  `json:"java_id,omitempty"`
+	TID    string  `json:"tid"`
+	NID    int     `json:"nid"`
+	CPU    float64 `json:"cpu_seconds"`
+	Reuses string  `json:"reuses_tid,omitempty"`
+}
+
+func newJSONChange(c *ThreadChange) jsonChange {
+	res := jsonChange{
+		Name:   c.Thread.Name,
+		JavaID: c.Thread.JavaID,
+		TID:    c.Thread.TID,
+		NID:    c.Thread.NID,
+		CPU:    c.CPU.Seconds(),
+	}
+	if c.Reuses != nil {
+		res.Reuses = c.Reuses.TID
+	}
+	return res
+}
+
+// CPU available to the target and the throttling incurred over the report.
+type jsonLimit struct {
+	CPUs          float64 `json:"cpus"`
+	Source        string  `json:"source"`
+	Fraction      float64 `json:"fraction"`
+	Periods       uint64  `json:"nr_periods"`
+	Throttled     uint64  `json:"nr_throttled"`
+	ThrottledTime float64 `json:"throttled_seconds"`
+}
+
+// The target's process-wide CPU usage, reconciled against its threads.
+type jsonProcess struct {
+	CPU         float64 `json:"cpu_seconds"`
+	Threads     float64 `json:"threads_cpu_seconds"`
+	Native      float64 `json:"other_threads_cpu_seconds"`
+	NativeCount int     `json:"other_threads"`
+	Unaccounted float64 `json:"unaccounted_cpu_seconds"`
+	Children    float64 `json:"children_cpu_seconds"`
+}
+
+type jsonChurn struct {
+	Pool        string  `json:"pool"`
+	Created     int     `json:"created"`
+	Exited      int     `json:"exited"`
+	CreatedRate float64 `json:"created_per_second"`
+	ExitedRate  float64 `json:"exited_per_second"`
+}
+
+// JSON cannot represent NaN or infinities, which we get for threads with no
+// elapsed time.
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+func newJSONThread(t *ThreadCPU, summary bool) jsonThread {
+	res := jsonThread{
+		Name:     t.Thread.Name,
+		TID:      t.Thread.TID,
+		NID:      t.Thread.NID,
+		Header:   t.Thread.Header,
+		CPU:      t.CPU.Seconds(),
+		Elapsed:  t.Elapsed.Seconds(),
+		Fraction: finite(t.Frac),
+	}
+	if !summary {
+		res.Stack = t.Thread.Stack
+	}
+	return res
+}
+
+// A report for a target, as sampled by the server.
+type targetReport struct {
+	target string
+	pid    int
+	time   time.Time
+	report *Report
+}
+
+type server struct {
+	targets   []string
+	sample    time.Duration
+	maxSample time.Duration
+
+	// Limits the thread dumps run on behalf of requests
+	sampling chan struct{}
+
+	mu     sync.Mutex
+	latest map[string]*targetReport
+}
+
+func (s *server) resolveTarget(r *http.Request) (string, error) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		if len(s.targets) != 1 {
+			return "", errors.New("target parameter required")
+		}
+		return s.targets[0], nil
+	}
+	for _, t := range s.targets {
+		if t == target {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown target \"%s\"", target)
+}
+
+// Reserve a slot to take thread dumps for a request, returning false if the
+// server is already at its limit. Call done when finished.
+func (s *server) acquire() bool {
+	select {
+	case s.sampling <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) done() {
+	<-s.sampling
+}
+
+var errBusy = errors.New("too many samples in progress")
+
+func (s *server) collect(ctx context.Context, target string, duration time.Duration) (*targetReport, error) {
+	pid, err := parseJavaPID(target)
+	if err != nil {
+		return nil, err
+	}
+	sample, err := sampleProcess(ctx, pid, duration, defaultCollectOptions)
+	if err != nil {
+		return nil, err
+	}
+	report, err := sample.Report()
+	if err != nil {
+		return nil, err
+	}
+	return &targetReport{target, pid, sample.Dump1.Time, report}, nil
+}
+
+// Produce a report for the request. An explicit sample parameter always
+// triggers a new sample. Otherwise the most recent scheduled report is used if
+// there is one.
+func (s *server) report(r *http.Request) (*targetReport, int, error) {
+	target, err := s.resolveTarget(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	duration := s.sample
+	if v := r.URL.Query().Get("sample"); v != "" {
+		duration, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid sample: %w", err)
+		}
+		if duration > s.maxSample {
+			return nil, http.StatusBadRequest, fmt.Errorf("sample exceeds maximum of %s", s.maxSample)
+		}
+	} else {
+		s.mu.Lock()
+		latest := s.latest[target]
+		s.mu.Unlock()
+		if latest != nil {
+			return latest, http.StatusOK, nil
+		}
+	}
+
+	if !s.acquire() {
+		return nil, http.StatusTooManyRequests, errBusy
+	}
+	defer s.done()
+
+	res, err := s.collect(r.Context(), target, duration)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return res, http.StatusOK, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+func wantText(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "text"
+}
+
+func (s *server) handleTop(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n, _ := strconv.Atoi(q.Get("n"))
+	summary := q.Get("summary") != "" && q.Get("summary") != "false"
+
+	res, status, err := s.report(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if wantText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeReport(w, res.report, n, summary, true, nil, nil)
+		return
+	}
+
+	out := jsonReport{
+		Target:   res.target,
+		PID:      res.pid,
+		Time:     res.time,
+		Threads:  []jsonThread{},
+		TotalCPU: res.report.TotalCPU.Seconds(),
+		Elapsed:  res.report.Elapsed.Seconds(),
+		Fraction: finite(res.report.TotalFrac),
+		Partial:  res.report.Partial,
+	}
+	if res.report.Skew > 0 {
+		out.Capture = []float64{res.report.Capture[0].Seconds(), res.report.Capture[1].Seconds()}
+		out.Skew = res.report.Skew.Seconds()
+	}
+	if p := res.report.Process; p != nil {
+		out.Process = &jsonProcess{
+			CPU:         p.CPU.Seconds(),
+			Threads:     p.Threads.Seconds(),
+			Native:      p.Native.Seconds(),
+			NativeCount: p.NativeCount,
+			Unaccounted: p.Unaccounted.Seconds(),
+			Children:    p.Children.Seconds(),
+		}
+	}
+	if l := res.report.CPULimit; l != nil {
+		out.CPULimit = &jsonLimit{
+			CPUs:          l.CPUs,
+			Source:        l.Source,
+			Fraction:      finite(res.report.TotalFrac / l.CPUs),
+			Periods:       l.Periods,
+			Throttled:     l.Throttled,
+			ThrottledTime: l.ThrottledTime.Seconds(),
+		}
+	}
+	for _, t := range res.report.Top(n) {
+		out.Threads = append(out.Threads, newJSONThread(t, summary))
+	}
+	for _, c := range res.report.Created {
+		out.Created = append(out.Created, newJSONChange(c))
+	}
+	for _, c := range res.report.Exited {
+		out.Exited = append(out.Exited, newJSONChange(c))
+	}
+	for _, p := range res.report.Churn() {
+		out.Churn = append(out.Churn, &jsonChurn{
+			Pool:        p.Pool,
+			Created:     p.Created,
+			Exited:      p.Exited,
+			CreatedRate: res.report.rate(p.Created),
+			ExitedRate:  res.report.rate(p.Exited),
+		})
+	}
+	writeJSON(w, out)
+}
+
+// Threads may be identified by their tid (e.g. 0x00007fdf6000b000) or by their
+// native ID (nid), in decimal or hex.
+func matchThread(t *Thread, id string) bool {
+	if t.TID == id {
+		return true
+	}
+	nid, err := strconv.ParseInt(id, 0, 64)
+	return err == nil && int(nid) == t.NID
+}
+
+func (s *server) handleThread(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/threads/")
+	if id == "" {
+		http.Error(w, "thread ID required", http.StatusBadRequest)
+		return
+	}
+
+	res, status, err := s.report(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	for _, t := range res.report.Threads {
+		if !matchThread(t.Thread, id) {
+			continue
+		}
+		if wantText(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeHeader(w, true, t.Frac, t.Thread.Header)
+			fmt.Fprintln(w, t.Thread.Stack)
+		} else {
+			writeJSON(w, newJSONThread(t, false))
+		}
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+func (s *server) handleDump(w http.ResponseWriter, r *http.Request) {
+	target, err := s.resolveTarget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pid, err := parseJavaPID(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !s.acquire() {
+		http.Error(w, errBusy.Error(), http.StatusTooManyRequests)
+		return
+	}
+	dump, err := jstack(pid)
+	s.done()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if wantText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, dump.Text)
+		return
+	}
+
+	writeJSON(w, struct {
+		Target string    `json:"target"`
+		PID    int       `json:"pid"`
+		Time   time.Time `json:"time"`
+		Text   string    `json:"text"`
+	}{target, pid, dump.Time, dump.Text})
+}
+
+func (s *server) handleTargets(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, s.targets)
+}
+
+// Sample the target every interval, retaining the latest report.
+func (s *server) schedule(target string, interval time.Duration) {
+	for {
+		res, err := s.collect(context.Background(), target, s.sample)
+		if err != nil {
+			log.Printf("%s: %v", target, err)
+		} else {
+			s.mu.Lock()
+			s.latest[target] = res
+			s.mu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Implements "jtopthreads serve", which exposes thread CPU reports over HTTP.
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s serve [options] <pid | main-class>...\n\n", os.Args[0])
+		fmt.Fprint(out, "endpoints:\n")
+		fmt.Fprint(out, "  /                   list targets\n")
+		fmt.Fprint(out, "  /top                busiest threads (target, n, sample, summary, format)\n")
+		fmt.Fprint(out, "  /threads/<tid|nid>  a single thread (target, sample, format)\n")
+		fmt.Fprint(out, "  /dump               raw thread dump (target, format)\n\n")
+		fs.PrintDefaults()
+	}
+
+	s := &server{
+		maxSample: time.Minute,
+		latest:    make(map[string]*targetReport),
+	}
+	listen := "127.0.0.1:8080"
+	interval := time.Duration(0)
+	maxRequests := 1
+
+	fs.StringVar(&listen, "listen", listen, "listen on `address`")
+	fs.DurationVar(&s.sample, "sample", s.sample, "default sample `duration`")
+	fs.DurationVar(&s.maxSample, "max-sample", s.maxSample, "maximum sample `duration` clients may request")
+	fs.DurationVar(&interval, "interval", interval, "sample each target every `duration` in the background\nand serve the latest report to requests without a sample parameter")
+	fs.IntVar(&maxRequests, "max-requests", maxRequests, "maximum `number` of requests taking thread dumps at once;\nothers are rejected with 429 Too Many Requests")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || maxRequests < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	s.sampling = make(chan struct{}, maxRequests)
+	s.targets = fs.Args()
+
+	if interval > 0 {
+		for _, target := range s.targets {
+			go s.schedule(target, interval)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleTargets)
+	mux.HandleFunc("/top", s.handleTop)
+	mux.HandleFunc("/threads/", s.handleThread)
+	mux.HandleFunc("/dump", s.handleDump)
+
+	log.Printf("listening on %s", listen)
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A single "at ..." line from a Java stack trace, e.g.
+//
+//	at java.lang.Thread.run(java.base@11.0.10/Thread.java:834)
+type Frame struct {
+	// Fully qualified method name (e.g. java.lang.Thread.run)
+	Method string
+	// Source file name (e.g. Thread.java), if known
+	File string
+	// Line number, or zero if unknown
+	Line int
+	// Module and version (e.g. java.base@11.0.10), if present
+	Module string
+}
+
+// The fully qualified class name of the frame's method.
+func (f *Frame) Class() string {
+	if i := strings.LastIndexByte(f.Method, '.'); i >= 0 {
+		return f.Method[:i]
+	}
+	return ""
+}
+
+// The package name of the frame's class.
+func (f *Frame) Package() string {
+	class := f.Class()
+	if i := strings.LastIndexByte(class, '.'); i >= 0 {
+		return class[:i]
+	}
+	return ""
+}
+
+// Parse a stack line as a frame. Returns false if the line is not a frame
+// (e.g. the thread state or a "- locked <...>" line).
+func parseFrame(line string) (Frame, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "at ") {
+		return Frame{}, false
+	}
+	line = line[len("at "):]
+
+	open := strings.IndexByte(line, '(')
+	if open < 0 || !strings.HasSuffix(line, ")") {
+		return Frame{Method: line}, true
+	}
+
+	frame := Frame{Method: line[:open]}
+	source := line[open+1 : len(line)-1]
+	if i := strings.IndexByte(source, '/'); i >= 0 {
+		frame.Module = source[:i]
+		source = source[i+1:]
+	}
+
+	switch source {
+	case "Native Method", "Unknown Source":
+		return frame, true
+	}
+
+	if i := strings.LastIndexByte(source, ':'); i >= 0 {
+		if n, err := strconv.Atoi(source[i+1:]); err == nil {
+			frame.Line = n
+			source = source[:i]
+		}
+	}
+	if source != "Unknown Source" {
+		frame.File = source
+	}
+	return frame, true
+}
+
+// The thread's stack frames, innermost first.
+func (t *Thread) Frames() []Frame {
+	var frames []Frame
+	for _, l := range strings.Split(t.Stack, "\n") {
+		if frame, ok := parseFrame(l); ok {
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
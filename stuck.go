@@ -0,0 +1,305 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of stuck thread, in the order they are reported.
+const (
+	stuckSpinning = "spinning"
+	stuckBlocked  = "blocked"
+	stuckWaiting  = "waiting"
+	stuckNative   = "stuck"
+)
+
+var stuckOrder = map[string]int{stuckSpinning: 0, stuckBlocked: 1, stuckWaiting: 2, stuckNative: 3}
+
+// RUNNABLE threads with an unchanging stack which use at least this fraction
+// of a CPU are considered to be spinning, and those using less than
+// stuckIdleFrac are considered to be stuck (e.g. in a native I/O call).
+const (
+	stuckSpinFrac = 0.5
+	stuckIdleFrac = 0.01
+)
+
+// A thread whose state and stack were identical across consecutive samples.
+type stuckThread struct {
+	thread   *Thread
+	kind     string
+	samples  int
+	duration time.Duration
+	cpu      time.Duration
+	frac     float64
+	// The monitor a blocked or waiting thread is waiting for and the thread
+	// holding it, if any.
+	monitor string
+	owner   *Thread
+}
+
+var (
+	// e.g. "- waiting to lock <0x000000071ab7f1a8> (a java.lang.Object)"
+	waitingMonitorRE = regexp.MustCompile(`- (?:waiting to lock|waiting on|waiting to re-lock in wait\(\)|parking to wait for) +<(0x[0-9a-f]+)>`)
+	// e.g. "- locked <0x000000071ab7f1a8>" or, in the "Locked ownable
+	// synchronizers" section of jstack -l, "- <0x000000071ab7f1a8>"
+	lockedMonitorRE = regexp.MustCompile(`- (?:locked )?<(0x[0-9a-f]+)>`)
+	// Native methods in which idle RUNNABLE threads wait for events or
+	// connections, e.g. "sun.nio.ch.EPoll.wait" or "Native.epollWait"
+	idleNativeRE = regexp.MustCompile(`\.(?:wait|epollWait0?|epollBusyWait0|kevent0|poll0?|select0?|accept0?|socketAccept)$`)
+)
+
+// Whether the thread is idle in a native wait for events or connections,
+// rather than stuck.
+func idleNative(t *Thread) bool {
+	frames := t.Frames()
+	return len(frames) > 0 && frames[0].File == "" && idleNativeRE.MatchString(frames[0].Method)
+}
+
+// The address of the monitor the thread is waiting for, if any.
+func waitingMonitor(t *Thread) string {
+	if m := waitingMonitorRE.FindStringSubmatch(t.Stack); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// Find the threads in the last dump whose state and stack were unchanged in
+// at least need consecutive dumps up to and including the last. Stacks are
+// compared as dumped (not normalized), so that a thread waiting on a
+// different monitor in each dump is not stuck.
+func findStuck(dumps []*StackDump, need int) ([]*stuckThread, error) {
+	var threads []map[string]*Thread
+	for _, dump := range dumps {
+		t, err := dump.ParseThreads()
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, t)
+	}
+	last := len(dumps) - 1
+
+	// Monitors held by each thread in the last dump
+	owners := make(map[string]*Thread)
+	for _, t := range threads[last] {
+		lines := strings.Split(t.Stack, "\n")
+		// A thread in Object.wait() has released the monitor it waits on, but
+		// older JVMs still list it as "- locked" by the calling frame
+		released := make(map[string]bool)
+		for _, l := range lines {
+			if m := waitingMonitorRE.FindStringSubmatch(l); m != nil && strings.Contains(l, "waiting on") {
+				released[m[1]] = true
+			}
+		}
+		for _, l := range lines {
+			if strings.Contains(l, "waiting") || strings.Contains(l, "parking") {
+				continue
+			}
+			if m := lockedMonitorRE.FindStringSubmatch(l); m != nil && !released[m[1]] {
+				owners[m[1]] = t
+			}
+		}
+	}
+
+	var stuck []*stuckThread
+	for key, t1 := range threads[last] {
+		first := last
+		for first > 0 {
+			t0, ok := threads[first-1][key]
+			if !ok || t0.Stack != t1.Stack || t0.State != t1.State {
+				break
+			}
+			first--
+		}
+		if last-first+1 < need || first == last {
+			continue
+		}
+
+		t0 := threads[first][key]
+		s := &stuckThread{thread: t1, samples: last - first + 1, cpu: t1.CPU - t0.CPU}
+		if dumps[first].Time.IsZero() || dumps[last].Time.IsZero() {
+			s.duration = t1.Elapsed - t0.Elapsed
+		} else {
+			start, _ := dumps[first].captureTime()
+			end, _ := dumps[last].captureTime()
+			s.duration = end.Sub(start)
+		}
+		if s.duration > 0 {
+			s.frac = float64(s.cpu) / float64(s.duration)
+		}
+
+		switch t1.State {
+		case "RUNNABLE":
+			if s.frac >= stuckSpinFrac {
+				s.kind = stuckSpinning
+			} else if s.frac < stuckIdleFrac && !idleNative(t1) {
+				s.kind = stuckNative
+			}
+		case "BLOCKED":
+			s.kind = stuckBlocked
+			s.monitor = waitingMonitor(t1)
+			s.owner = owners[s.monitor]
+		case "WAITING", "TIMED_WAITING":
+			// Idle threads wait indefinitely, so only report waiting threads
+			// if another thread holds what they are waiting for.
+			s.monitor = waitingMonitor(t1)
+			if owner, ok := owners[s.monitor]; ok && owner != t1 {
+				s.kind = stuckWaiting
+				s.owner = owner
+			}
+		}
+		if s.kind != "" {
+			stuck = append(stuck, s)
+		}
+	}
+
+	sort.Slice(stuck, func(i, j int) bool {
+		if stuck[i].kind != stuck[j].kind {
+			return stuckOrder[stuck[i].kind] < stuckOrder[stuck[j].kind]
+		}
+		if stuck[i].duration != stuck[j].duration {
+			return stuck[i].duration > stuck[j].duration
+		}
+		return stuck[i].thread.key() < stuck[j].thread.key()
+	})
+	return stuck, nil
+}
+
+func writeStuck(w io.Writer, stuck []*stuckThread, n int, summary bool, tty bool) {
+	if len(stuck) == 0 {
+		fmt.Fprintln(w, "No stuck threads found")
+		return
+	}
+	if n > 0 && len(stuck) > n {
+		stuck = stuck[:n]
+	}
+	for _, s := range stuck {
+		writeHeader(w, tty, s.frac, s.thread.Header)
+		fmt.Fprintf(w, "   %s for %s (%d samples)", s.kind, s.duration.Round(time.Millisecond), s.samples)
+		if s.monitor != "" {
+			fmt.Fprintf(w, " on <%s>", s.monitor)
+			if s.owner != nil {
+				fmt.Fprintf(w, " held by \"%s\" nid=0x%x", s.owner.Name, s.owner.NID)
+			}
+		}
+		fmt.Fprintln(w)
+		if !summary {
+			if len(s.thread.Stack) > 0 {
+				fmt.Fprintln(w, s.thread.Stack)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// Implements "jtopthreads stuck", which looks for threads whose stack does not
+// change across several samples.
+func stuckMain(args []string) {
+	fs := flag.NewFlagSet("stuck", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s stuck [options] <pid | main-class>\n", os.Args[0])
+		fmt.Fprintf(out, "   or: %s stuck [options] <bundle-file | recording | stack-file...>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	count := 3
+	interval := 5 * time.Second
+	n := 0
+	summary := false
+
+	fs.IntVar(&count, "count", count, "report threads unchanged across `N` consecutive samples")
+	fs.DurationVar(&interval, "interval", interval, "wait `duration` between samples of a live process")
+	fs.IntVar(&n, "n", n, "limit output to `N` threads")
+	fs.BoolVar(&summary, "summary", summary, "omit stacks")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || count < 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var dumps []*StackDump
+	if _, err := os.Stat(fs.Arg(0)); err == nil {
+		if isBundle(fs.Arg(0)) || isRecording(fs.Arg(0)) {
+			if fs.NArg() > 1 {
+				fs.Usage()
+				os.Exit(1)
+			}
+			dumps, err = readSamples(fs.Arg(0))
+		} else {
+			for _, path := range fs.Args() {
+				var dump *StackDump
+				dump, err = readStackDump(path, "")
+				if err != nil {
+					break
+				}
+				dumps = append(dumps, dump)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		pid, err := parseJavaPID(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Include java.util.concurrent locks, so their owners can be found
+		copts := collectOptions{timeout: defaultCollectOptions.timeout, locks: true}
+		for i := 0; i < count; i++ {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			dump, err := collectDump(context.Background(), pid, copts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dumps = append(dumps, dump)
+		}
+	}
+
+	// Skip samples with only /proc stats (e.g. from a black box recording)
+	var full []*StackDump
+	for _, dump := range dumps {
+		if dump.Text != "" {
+			full = append(full, dump)
+		}
+	}
+	dumps = full
+
+	if len(dumps) < count {
+		log.Fatalf("need at least %d samples, have %d", count, len(dumps))
+	}
+
+	stuck, err := findStuck(dumps, count)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeStuck(os.Stdout, stuck, n, summary, isTerminal(os.Stdout))
+}
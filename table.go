@@ -0,0 +1,406 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+)
+
+// A thread in a tabular report, with the fields of its header split out. This
+// is also the data passed to -template.
+type tableRow struct {
+	// Label of the thread's process in multi-process reports
+	Process string
+	// Thread name, and the name of its pool (see poolName)
+	Name string
+	Pool string
+	// Java thread ID (e.g. "#27"), if present
+	JavaID string
+	Daemon bool
+	// Java and OS thread priorities, if present
+	Prio   string
+	OSPrio string
+	// Address of the JVM's thread structure (e.g. "0x00007f5de4067800")
+	TID string
+	// Native (OS) thread ID
+	NID int
+	// Thread state (e.g. "RUNNABLE"), if present
+	State string
+	// CPU used and time elapsed over the report window
+	CPU     time.Duration
+	Elapsed time.Duration
+	// CPU used as a fraction of the time elapsed
+	Frac float64
+	// The raw header line and stack from the thread dump
+	Header string
+	Stack  string
+}
+
+func newTableRow(t *ThreadCPU) *tableRow {
+	row := &tableRow{
+		Process: t.Process,
+		Name:    t.Thread.Name,
+		Pool:    poolName(t.Thread.Name),
+		JavaID:  t.Thread.JavaID,
+		TID:     t.Thread.TID,
+		NID:     t.Thread.NID,
+		State:   t.Thread.State,
+		CPU:     t.CPU,
+		Elapsed: t.Elapsed,
+		Frac:    t.Frac,
+		Header:  t.Thread.Header,
+		Stack:   t.Thread.Stack,
+	}
+
+	// The name may contain anything, so only look at fields following it.
+	// getHeaderField isn't used as "prio=" also matches "os_prio=", and VM
+	// threads have only the latter.
+	header := t.Thread.Header
+	if i := strings.LastIndexByte(header, '"'); i >= 0 {
+		header = header[i+1:]
+	}
+	for _, field := range strings.Fields(header) {
+		switch {
+		case field == "daemon":
+			row.Daemon = true
+		case strings.HasPrefix(field, "prio="):
+			row.Prio = field[len("prio="):]
+		case strings.HasPrefix(field, "os_prio="):
+			row.OSPrio = field[len("os_prio="):]
+		}
+	}
+	return row
+}
+
+// CPU usage as a percentage (e.g. "97.73%").
+func (row *tableRow) Percent() string {
+	return fmt.Sprintf("%.2f%%", 100*row.Frac)
+}
+
+// A column which can be selected with -columns.
+type column struct {
+	name    string
+	numeric bool
+	value   func(row *tableRow) string
+}
+
+var columns = []*column{
+	{"process", false, func(row *tableRow) string { return row.Process }},
+	{"cpu", true, func(row *tableRow) string { return row.Percent() }},
+	{"name", false, func(row *tableRow) string { return row.Name }},
+	{"pool", false, func(row *tableRow) string { return row.Pool }},
+	{"java_id", false, func(row *tableRow) string { return row.JavaID }},
+	{"daemon", false, func(row *tableRow) string { return strconv.FormatBool(row.Daemon) }},
+	{"prio", true, func(row *tableRow) string { return row.Prio }},
+	{"os_prio", true, func(row *tableRow) string { return row.OSPrio }},
+	{"tid", false, func(row *tableRow) string { return row.TID }},
+	{"nid", false, func(row *tableRow) string { return fmt.Sprintf("0x%x", row.NID) }},
+	{"state", false, func(row *tableRow) string { return row.State }},
+	{"cpu_seconds", true, func(row *tableRow) string { return fmt.Sprintf("%.6f", row.CPU.Seconds()) }},
+	{"elapsed_seconds", true, func(row *tableRow) string { return fmt.Sprintf("%.6f", row.Elapsed.Seconds()) }},
+	{"fraction", true, func(row *tableRow) string { return fmt.Sprintf("%.6f", row.Frac) }},
+	{"header", false, func(row *tableRow) string { return row.Header }},
+}
+
+func columnNames() []string {
+	var names []string
+	for _, c := range columns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// The columns of csv, tsv and markdown tables, unless -columns is given.
+var tableColumns = []string{"name", "java_id", "daemon", "prio", "os_prio", "tid", "nid", "state", "cpu_seconds", "elapsed_seconds", "fraction"}
+
+// A selected column, with values truncated to width if it is positive.
+type columnSpec struct {
+	*column
+	width int
+}
+
+// Parse a -columns list such as "cpu,state,name:30", where a ":N" suffix
+// truncates the column to N characters.
+func parseColumns(list string) ([]columnSpec, error) {
+	var specs []columnSpec
+	for _, field := range strings.Split(list, ",") {
+		name := strings.TrimSpace(field)
+		width := 0
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			w, err := strconv.Atoi(name[i+1:])
+			if err != nil || w <= 0 {
+				return nil, fmt.Errorf("invalid column width in \"%s\"", field)
+			}
+			name, width = name[:i], w
+		}
+		var col *column
+		for _, c := range columns {
+			if c.name == name {
+				col = c
+			}
+		}
+		if col == nil {
+			return nil, fmt.Errorf("unknown column \"%s\" (expected one of %s)", name, strings.Join(columnNames(), ", "))
+		}
+		specs = append(specs, columnSpec{col, width})
+	}
+	return specs, nil
+}
+
+// Shorten s to at most width characters, marking truncation with "…".
+func truncate(width int, s string) string {
+	if width <= 0 || utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
+
+// Replaces the raw header line of each thread in text output with selected
+// columns (-columns) or the output of a template (-template).
+type lineFormat struct {
+	columns  []columnSpec
+	template *template.Template
+	// Truncate lines to width characters if positive, e.g. to fit a terminal
+	width int
+}
+
+// Parse a -template, checking the fields it reads from the row so that
+// references to unknown fields are reported up front. The template is not
+// executed, since functions such as index and slice fail on an empty row.
+func parseLineTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("line").Funcs(template.FuncMap{"truncate": truncate}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRowFields(tmpl.Tree.Root, true); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Check that the fields read from the row by node exist. Fields of dot are
+// only checked where dot is the row (dotRow), i.e. outside range and with.
+func checkRowFields(node parse.Node, dotRow bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, c := range n.Nodes {
+				if err := checkRowFields(c, dotRow); err != nil {
+					return err
+				}
+			}
+		}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, c := range n.Cmds {
+				for _, a := range c.Args {
+					if err := checkRowFields(a, dotRow); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case *parse.ActionNode:
+		return checkRowFields(n.Pipe, dotRow)
+	case *parse.TemplateNode:
+		return checkRowFields(n.Pipe, dotRow)
+	case *parse.ChainNode:
+		return checkRowFields(n.Node, dotRow)
+	case *parse.FieldNode:
+		if dotRow {
+			return checkRowField(n.Ident[0])
+		}
+	case *parse.VariableNode:
+		// $ is always the row
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			return checkRowField(n.Ident[1])
+		}
+	case *parse.IfNode:
+		return checkBranchFields(&n.BranchNode, dotRow, dotRow)
+	case *parse.RangeNode:
+		return checkBranchFields(&n.BranchNode, dotRow, false)
+	case *parse.WithNode:
+		return checkBranchFields(&n.BranchNode, dotRow, false)
+	}
+	return nil
+}
+
+// Check an if, range or with, whose body may have a different dot.
+func checkBranchFields(n *parse.BranchNode, dotRow, bodyDotRow bool) error {
+	if err := checkRowFields(n.Pipe, dotRow); err != nil {
+		return err
+	}
+	if err := checkRowFields(n.List, bodyDotRow); err != nil {
+		return err
+	}
+	return checkRowFields(n.ElseList, dotRow)
+}
+
+func checkRowField(name string) error {
+	row := reflect.TypeOf(&tableRow{})
+	if _, ok := row.Elem().FieldByName(name); ok {
+		return nil
+	}
+	if _, ok := row.MethodByName(name); ok {
+		return nil
+	}
+	return fmt.Errorf("can't evaluate field %s in type tableRow", name)
+}
+
+// Format the line for each thread. Columns are aligned for tty output and
+// tab-separated otherwise.
+func (f *lineFormat) lines(threads []*ThreadCPU, tty bool) []string {
+	var lines []string
+	if f.template != nil {
+		for _, t := range threads {
+			var buf bytes.Buffer
+			if err := f.template.Execute(&buf, newTableRow(t)); err != nil {
+				// Fields are checked when parsed, but e.g. index can fail
+				fmt.Fprintf(&buf, "template error: %v", err)
+			}
+			lines = append(lines, strings.TrimRight(buf.String(), "\n"))
+		}
+	} else {
+		values := make([][]string, len(threads))
+		widths := make([]int, len(f.columns))
+		for i, t := range threads {
+			row := newTableRow(t)
+			for j, c := range f.columns {
+				v := truncate(c.width, c.value(row))
+				values[i] = append(values[i], v)
+				if n := utf8.RuneCountInString(v); n > widths[j] {
+					widths[j] = n
+				}
+			}
+		}
+		for _, vs := range values {
+			if !tty {
+				lines = append(lines, strings.Join(vs, "\t"))
+				continue
+			}
+			for j, c := range f.columns {
+				switch {
+				case c.numeric:
+					vs[j] = fmt.Sprintf("%*s", widths[j], vs[j])
+				case j < len(vs)-1:
+					vs[j] = fmt.Sprintf("%-*s", widths[j], vs[j])
+				}
+			}
+			lines = append(lines, strings.Join(vs, "  "))
+		}
+	}
+	if tty {
+		for i, l := range lines {
+			lines[i] = truncate(f.width, l)
+		}
+	}
+	return lines
+}
+
+// Write the n busiest threads in the report as a table in the given format
+// (csv, tsv or markdown), with one row per thread. Multi-process reports have
+// an additional leading process column, unless specific columns are selected.
+func writeTable(w io.Writer, report *Report, n int, format string, selected []columnSpec) error {
+	threads := report.Top(n)
+
+	specs := selected
+	if specs == nil {
+		names := tableColumns
+		if len(report.Processes) > 0 {
+			names = append([]string{"process"}, names...)
+		}
+		var err error
+		if specs, err = parseColumns(strings.Join(names, ",")); err != nil {
+			return err
+		}
+	}
+	var header []string
+	for _, c := range specs {
+		header = append(header, c.name)
+	}
+	var rows [][]string
+	for _, t := range threads {
+		row := newTableRow(t)
+		var values []string
+		for _, c := range specs {
+			values = append(values, truncate(c.width, c.value(row)))
+		}
+		rows = append(rows, values)
+	}
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		cw.WriteAll(rows)
+		return cw.Error()
+	case "tsv":
+		// Tabs and newlines can only appear in thread names, and would break
+		// the table
+		clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+		for _, values := range append([][]string{header}, rows...) {
+			for i, v := range values {
+				values[i] = clean.Replace(v)
+			}
+			if _, err := fmt.Fprintln(w, strings.Join(values, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "markdown":
+		escape := strings.NewReplacer("|", "\\|", "\n", " ", "\r", " ")
+		line := func(values []string) error {
+			for i, v := range values {
+				values[i] = escape.Replace(v)
+			}
+			_, err := fmt.Fprintf(w, "| %s |\n", strings.Join(values, " | "))
+			return err
+		}
+		if err := line(header); err != nil {
+			return err
+		}
+		// Right align the numeric columns
+		align := make([]string, len(specs))
+		for i, c := range specs {
+			if c.numeric {
+				align[i] = "---:"
+			} else {
+				align[i] = "---"
+			}
+		}
+		if _, err := fmt.Fprintf(w, "|%s|\n", strings.Join(align, "|")); err != nil {
+			return err
+		}
+		for _, values := range rows {
+			if err := line(values); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown table format \"%s\"", format)
+	}
+}
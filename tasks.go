@@ -0,0 +1,94 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+// CPU usage of a process and each of its tasks (threads) at a point in time,
+// read from /proc. This is much cheaper than a thread dump and does not pause
+// the JVM.
+type taskSample struct {
+	time    time.Time
+	pid     int
+	process uint64
+	ticks   map[int]uint64
+	comm    map[int]string
+}
+
+func readTaskSample(pid int) (*taskSample, error) {
+	now := time.Now()
+	stats, err := collectProcStats(pid)
+	if err != nil {
+		return nil, err
+	}
+	if stats == nil {
+		return nil, fmt.Errorf("process %d not found", pid)
+	}
+
+	sample := &taskSample{
+		time:  now,
+		pid:   pid,
+		ticks: make(map[int]uint64),
+		comm:  make(map[int]string),
+	}
+	for tid, line := range stats {
+		stat, err := proc.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		// The entry for the pid is the process as a whole
+		if tid == pid {
+			sample.process = stat.Utime + stat.Stime
+			continue
+		}
+		sample.ticks[tid] = stat.Utime + stat.Stime
+		sample.comm[tid] = stat.Comm
+	}
+	return sample, nil
+}
+
+// CPU used by a single task between two samples
+type taskCPU struct {
+	tid  int
+	comm string
+	cpu  time.Duration
+	frac float64
+}
+
+// Per-task and whole process CPU usage between two samples. Tasks which only
+// exist in the later sample are charged all of their CPU.
+func taskDelta(s0, s1 *taskSample) ([]*taskCPU, float64) {
+	elapsed := s1.time.Sub(s0.time)
+	var tasks []*taskCPU
+	for tid, t1 := range s1.ticks {
+		ticks := t1
+		if t0, ok := s0.ticks[tid]; ok && t0 <= t1 {
+			ticks = t1 - t0
+		}
+		cpu := proc.Duration(ticks)
+		tasks = append(tasks, &taskCPU{tid, s1.comm[tid], cpu, float64(cpu) / float64(elapsed)})
+	}
+
+	var process float64
+	if s1.process >= s0.process {
+		process = float64(proc.Duration(s1.process-s0.process)) / float64(elapsed)
+	}
+	return tasks, process
+}
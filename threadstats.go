@@ -0,0 +1,314 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per-thread CPU usage read from a companion file captured alongside a thread
+// dump (e.g. the output of "ps -L" or "top -H"). This allows Java 8 dumps,
+// which lack cpu= and elapsed= header fields, to be analyzed offline.
+type ThreadStat struct {
+	CPU     time.Duration
+	Elapsed time.Duration
+	// Whether Elapsed is the time of day (from top), which wraps at midnight,
+	// and the system uptime reported alongside it (to the minute), if known
+	clock  bool
+	uptime time.Duration
+}
+
+// Parse the output of one of the supported tools, keyed by native thread ID.
+// The format is detected from the content. Supported formats are,
+//
+//	ps -L -o tid,time,etime -p <pid>
+//	top -H -b -n1 -p <pid>
+//	pidstat -t -p <pid>
+func ParseThreadStats(text string) (map[int]ThreadStat, error) {
+	lines := strings.Split(text, "\n")
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		if strings.HasPrefix(l, "top - ") {
+			return parseTopStats(lines)
+		}
+		break
+	}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if indexOf(fields, "TGID") >= 0 && indexOf(fields, "%CPU") >= 0 {
+			return parsePidstatStats(lines)
+		}
+	}
+	return parsePsStats(lines)
+}
+
+func indexOf(fields []string, names ...string) int {
+	for i, f := range fields {
+		for _, name := range names {
+			if f == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Parse durations of the form "[DD-][[HH:]MM:]SS[.frac]". This covers the
+// TIME and ELAPSED columns of ps as well as the TIME+ column of top (where
+// the minutes component may exceed 59).
+func parseClockDuration(s string) (time.Duration, error) {
+	var days int64
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		d, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration \"%s\"", s)
+		}
+		days = d
+		s = s[i+1:]
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid duration \"%s\"", s)
+	}
+
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration \"%s\"", s)
+	}
+	res := time.Duration(secs*float64(time.Second)) + time.Duration(days)*24*time.Hour
+
+	units := []time.Duration{time.Minute, time.Hour}
+	for i, p := range parts[:len(parts)-1] {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration \"%s\"", s)
+		}
+		res += time.Duration(n) * units[len(parts)-2-i]
+	}
+
+	return res, nil
+}
+
+func parsePsStats(lines []string) (map[int]ThreadStat, error) {
+	tidIdx, timeIdx, elapsedIdx := -1, -1, -1
+	res := make(map[int]ThreadStat)
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if tidIdx < 0 {
+			tidIdx = indexOf(fields, "TID", "LWP", "SPID")
+			timeIdx = indexOf(fields, "TIME", "CPUTIME")
+			elapsedIdx = indexOf(fields, "ELAPSED")
+			if tidIdx >= 0 && (timeIdx < 0 || elapsedIdx < 0) {
+				return nil, errors.New("ps output must include time and etime columns")
+			}
+			continue
+		}
+
+		if len(fields) <= tidIdx || len(fields) <= timeIdx || len(fields) <= elapsedIdx {
+			continue
+		}
+
+		tid, err := strconv.Atoi(fields[tidIdx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid thread ID \"%s\"", fields[tidIdx])
+		}
+		cpu, err := parseClockDuration(fields[timeIdx])
+		if err != nil {
+			return nil, err
+		}
+		elapsed, err := parseClockDuration(fields[elapsedIdx])
+		if err != nil {
+			return nil, err
+		}
+		res[tid] = ThreadStat{cpu, elapsed, false, 0}
+	}
+
+	if tidIdx < 0 {
+		return nil, errors.New("unrecognized thread stats format")
+	}
+	return res, nil
+}
+
+// top only reports cumulative CPU time, so the wall clock time from the
+// summary line ("top - 10:23:45 up ...") is used as the elapsed time. This
+// makes top output meaningful only when comparing two captures. Since it is
+// a time of day, it wraps at midnight (see unwrapClock).
+func parseTopStats(lines []string) (map[int]ThreadStat, error) {
+	// The summary line is the first non-blank line
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+
+	var clock time.Duration
+	header := strings.Fields(strings.TrimPrefix(lines[0], "top - "))
+	if len(header) > 0 {
+		c, err := parseClockDuration(header[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid top summary line: %w", err)
+		}
+		clock = c
+	}
+	uptime := parseTopUptime(lines[0])
+
+	pidIdx, timeIdx := -1, -1
+	res := make(map[int]ThreadStat)
+	for _, l := range lines[1:] {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if pidIdx < 0 {
+			if fields[0] == "PID" {
+				pidIdx = 0
+				timeIdx = indexOf(fields, "TIME+", "TIME")
+				if timeIdx < 0 {
+					return nil, errors.New("top output missing TIME+ column")
+				}
+			}
+			continue
+		}
+
+		if len(fields) <= timeIdx {
+			continue
+		}
+
+		tid, err := strconv.Atoi(fields[pidIdx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid thread ID \"%s\"", fields[pidIdx])
+		}
+		cpu, err := parseClockDuration(fields[timeIdx])
+		if err != nil {
+			return nil, err
+		}
+		res[tid] = ThreadStat{cpu, clock, true, uptime}
+	}
+
+	if pidIdx < 0 {
+		return nil, errors.New("top output missing task list")
+	}
+	return res, nil
+}
+
+// Parse the uptime from a top summary line, e.g. "up 3 days,  4:05," or
+// "up 35 min,". Returns zero if there is none.
+func parseTopUptime(line string) time.Duration {
+	i := strings.Index(line, " up ")
+	if i < 0 {
+		return 0
+	}
+	var uptime time.Duration
+	for _, part := range strings.Split(line[i+len(" up "):], ",") {
+		fields := strings.Fields(part)
+		switch {
+		case len(fields) == 2 && strings.HasPrefix(fields[1], "day"):
+			n, _ := strconv.Atoi(fields[0])
+			uptime += time.Duration(n) * 24 * time.Hour
+		case len(fields) == 2 && fields[1] == "min":
+			n, _ := strconv.Atoi(fields[0])
+			uptime += time.Duration(n) * time.Minute
+		case len(fields) == 1 && strings.Contains(fields[0], ":"):
+			hm, err := parseClockDuration(fields[0] + ":00")
+			if err == nil {
+				uptime += hm
+			}
+		default:
+			return uptime
+		}
+	}
+	return uptime
+}
+
+// Move the top clock times of a second capture past those of the first, as
+// the time of day wraps at midnight. The clock is only taken to have wrapped
+// if the uptimes agree, so that swapped captures are still reported as such.
+// Other stats are left unchanged.
+func unwrapClock(stats0, stats1 map[int]ThreadStat) {
+	var s0, s1 ThreadStat
+	for _, s0 = range stats0 {
+		break
+	}
+	for _, s1 = range stats1 {
+		break
+	}
+	if !s0.clock || !s1.clock || s1.Elapsed >= s0.Elapsed || s0.uptime == 0 || s1.uptime == 0 {
+		return
+	}
+	// The uptime has a resolution of a minute
+	wrapped := s1.Elapsed + 24*time.Hour - s0.Elapsed
+	if diff := s1.uptime - s0.uptime; diff < wrapped-time.Minute || diff > wrapped+time.Minute {
+		return
+	}
+	for tid, s := range stats1 {
+		s.Elapsed += 24 * time.Hour
+		stats1[tid] = s
+	}
+}
+
+// pidstat reports CPU usage as a percentage of each thread's lifetime rather
+// than cumulative time, so we record the percentage against a nominal one
+// second window. This is only meaningful when analyzing a single capture.
+func parsePidstatStats(lines []string) (map[int]ThreadStat, error) {
+	tidIdx, cpuIdx := -1, -1
+	res := make(map[int]ThreadStat)
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "Average") {
+			continue
+		}
+
+		// The header is repeated for each report and is prefixed with the
+		// report time, just like the rows that follow it.
+		if indexOf(fields, "TGID") >= 0 {
+			tidIdx = indexOf(fields, "TID")
+			cpuIdx = indexOf(fields, "%CPU")
+			if tidIdx < 0 || cpuIdx < 0 {
+				return nil, errors.New("pidstat output must be captured with -t")
+			}
+			continue
+		}
+
+		if tidIdx < 0 || len(fields) <= tidIdx || len(fields) <= cpuIdx {
+			continue
+		}
+
+		// Process summary lines have "-" in place of a thread ID
+		tid, err := strconv.Atoi(fields[tidIdx])
+		if err != nil {
+			continue
+		}
+		pct, err := strconv.ParseFloat(fields[cpuIdx], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %%CPU value \"%s\"", fields[cpuIdx])
+		}
+		res[tid] = ThreadStat{time.Duration(pct / 100 * float64(time.Second)), time.Second, false, 0}
+	}
+
+	if tidIdx < 0 {
+		return nil, errors.New("pidstat output missing header")
+	}
+	return res, nil
+}
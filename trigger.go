@@ -0,0 +1,264 @@
+// Copyright 2021 Chris Thunes
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2nes/jtopthreads/internal/proc"
+)
+
+// Parse a CPU percentage (e.g. "90%" or "90") as a fraction.
+func parsePercent(s string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage \"%s\"", s)
+	}
+	return pct / 100, nil
+}
+
+type percentFlag float64
+
+func (f *percentFlag) String() string {
+	return fmt.Sprintf("%g%%", float64(*f)*100)
+}
+
+func (f *percentFlag) Set(value string) error {
+	frac, err := parsePercent(value)
+	if err != nil {
+		return err
+	}
+	*f = percentFlag(frac)
+	return nil
+}
+
+type trigger struct {
+	pid          int
+	poll         time.Duration
+	threadLimit  float64
+	processLimit float64
+	window       time.Duration
+}
+
+// Describe why the sample is a spike, or return an empty string if it is not.
+func (t *trigger) spike(s0, s1 *taskSample) string {
+	tasks, process := taskDelta(s0, s1)
+	if t.processLimit > 0 && process > t.processLimit {
+		return fmt.Sprintf("process at %.2f%%", 100*process)
+	}
+	if t.threadLimit > 0 {
+		for _, task := range tasks {
+			if task.frac > t.threadLimit {
+				return fmt.Sprintf("thread %d (%s) at %.2f%%", task.tid, task.comm, 100*task.frac)
+			}
+		}
+	}
+	return ""
+}
+
+// Poll /proc until a spike is detected. Returns the reason for the spike and
+// the last sample from before it began.
+func (t *trigger) watch() (string, *taskSample, error) {
+	s0, err := readTaskSample(t.pid)
+	if err != nil {
+		return "", nil, err
+	}
+	for {
+		time.Sleep(t.poll)
+		s1, err := readTaskSample(t.pid)
+		if err != nil {
+			return "", nil, err
+		}
+		if reason := t.spike(s0, s1); reason != "" {
+			return reason, s0, nil
+		}
+		s0 = s1
+	}
+}
+
+// Take a thread dump, continue polling until the spike ends (or the window is
+// exceeded) and take a second thread dump. Returns the bracketing dumps and
+// the /proc sample taken just before the first.
+func (t *trigger) capture() (*StackDump, *StackDump, *taskSample, error) {
+	start, err := readTaskSample(t.pid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dump0, err := jstack(t.pid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	s0 := start
+	for time.Since(dump0.Time) < t.window {
+		time.Sleep(t.poll)
+		s1, err := readTaskSample(t.pid)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if t.spike(s0, s1) == "" {
+			break
+		}
+		s0 = s1
+	}
+
+	dump1, err := jstack(t.pid)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return dump0, dump1, start, nil
+}
+
+// Extend the report back to the last poll before the spike began, charging
+// each thread the CPU it used (according to /proc) between then and the first
+// thread dump, so that the report covers the whole spike.
+func extendReport(report *Report, base, start *taskSample) {
+	extra := start.time.Sub(base.time)
+	if extra <= 0 {
+		return
+	}
+	report.Elapsed += extra
+	var threadsCPU time.Duration
+	for _, t := range report.Threads {
+		// Threads created after the first dump are already charged all of
+		// their CPU
+		t1, ok := start.ticks[t.Thread.NID]
+		if !ok || t.Prev == nil {
+			continue
+		}
+		// Threads which started in between are charged all of their CPU
+		t0 := base.ticks[t.Thread.NID]
+		if t1 < t0 {
+			continue
+		}
+		cpu := proc.Duration(t1 - t0)
+		t.CPU += cpu
+		t.Elapsed += extra
+		threadsCPU += cpu
+	}
+	report.TotalCPU += threadsCPU
+	for _, t := range report.Threads {
+		t.Frac = float64(t.CPU) / float64(report.Elapsed)
+	}
+	report.sortThreads()
+	report.TotalFrac = float64(report.TotalCPU) / float64(report.Elapsed)
+	if p := report.Process; p != nil && start.process >= base.process {
+		p.CPU += proc.Duration(start.process - base.process)
+		p.Threads += threadsCPU
+	}
+}
+
+// Report a captured spike, saving its dumps to a bundle if save is set.
+func (t *trigger) report(reason string, base, start *taskSample, dump0, dump1 *StackDump, opts *outputOptions, save string) error {
+	report, err := NewReport(dump0, dump1)
+	if err != nil {
+		return err
+	}
+	extendReport(report, base, start)
+
+	fmt.Printf("Spike at %s: %s\n\n", base.time.Format(time.RFC3339), reason)
+	if err := printReport(os.Stdout, report, base.time, opts); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	if save == "" {
+		return nil
+	}
+	path := fmt.Sprintf("%s-%s.tar.gz", save, dump0.Time.Format("20060102T150405"))
+	w, err := CreateBundle(path, t.pid)
+	if err != nil {
+		return err
+	}
+	for _, dump := range []*StackDump{dump0, dump1} {
+		if err := w.Add(dump); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Implements "jtopthreads trigger", which cheaply polls /proc and only takes
+// thread dumps when CPU usage spikes.
+func triggerMain(args []string) {
+	fs := flag.NewFlagSet("trigger", flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s trigger [options] <pid | main-class>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	t := &trigger{
+		poll:        250 * time.Millisecond,
+		threadLimit: 0.9,
+		window:      5 * time.Second,
+	}
+	opts := &outputOptions{format: "text"}
+	count := 1
+	cooldown := time.Minute
+	save := ""
+
+	fs.DurationVar(&t.poll, "poll", t.poll, "poll /proc every `duration`")
+	fs.Var((*percentFlag)(&t.threadLimit), "thread", "trigger when any thread exceeds `percent` CPU (0 to disable)")
+	fs.Var((*percentFlag)(&t.processLimit), "process", "trigger when the process exceeds `percent` CPU (0 to disable)")
+	fs.DurationVar(&t.window, "window", t.window, "take the second thread dump after at most `duration`")
+	fs.IntVar(&count, "count", count, "exit after capturing `N` spikes (0 for no limit)")
+	fs.DurationVar(&cooldown, "cooldown", cooldown, "wait `duration` after a spike before watching for the next")
+	fs.StringVar(&save, "save", save, "also save each spike's thread dumps to a bundle named `prefix`-<time>.tar.gz")
+	fs.IntVar(&opts.n, "n", opts.n, "limit output to the top `N` threads")
+	fs.BoolVar(&opts.summary, "summary", opts.summary, "omit stacks")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || t.poll <= 0 || (t.threadLimit <= 0 && t.processLimit <= 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	pid, err := parseJavaPID(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	t.pid = pid
+
+	// Failures to dump or report a spike are logged and the spike skipped, so
+	// that a transient failure doesn't stop an unattended trigger. Only a
+	// failure to read /proc (e.g. the process exited) is fatal.
+	for captured := 0; count == 0 || captured < count; {
+		reason, base, err := t.watch()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		dump0, dump1, start, err := t.capture()
+		if err == nil {
+			err = t.report(reason, base, start, dump0, dump1, opts, save)
+		}
+		if err != nil {
+			log.Printf("skipping spike (%s): %v", reason, err)
+		} else {
+			captured++
+		}
+		if count == 0 || captured < count {
+			time.Sleep(cooldown)
+		}
+	}
+}